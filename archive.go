@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Activity archive (~/.mywhoosh2garmin/archive/YYYY/MM/)
+// ---------------------------------------------------------------------------
+
+// fixedSuffix marks the fixed version of an archived activity.
+const fixedSuffix = ".fixed.fit"
+
+// activityArchive keeps a copy of every MyWhoosh activity, because MyWhoosh
+// overwrites its export files. Originals are named after the activity start
+// time and a short content hash, e.g. 2024/05/2024-05-01_183012_1a2b3c4d.fit;
+// the fixed version sits next to it with the .fixed.fit suffix.
+type activityArchive struct {
+	dir string
+}
+
+func archiveDir() string {
+	return filepath.Join(appConfigDir(), "archive")
+}
+
+// OriginalPath returns where the original of the activity is archived.
+// The name uses the start time in UTC, so it doesn't change with the
+// machine's time zone.
+func (a activityArchive) OriginalPath(key activityKey) string {
+	hash := key.SHA256
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	if key.Start.IsZero() {
+		return filepath.Join(a.dir, "undated", hash+".fit")
+	}
+	start := key.Start.UTC()
+	return filepath.Join(a.dir, start.Format("2006"), start.Format("01"),
+		start.Format("2006-01-02_150405")+"_"+hash+".fit")
+}
+
+// fixedPath returns where the fixed version of an archived original goes.
+func fixedPath(original string) string {
+	return strings.TrimSuffix(original, ".fit") + fixedSuffix
+}
+
+// isFixedFile reports whether path is the fixed version of an activity.
+func isFixedFile(path string) bool {
+	return strings.HasSuffix(path, fixedSuffix)
+}
+
+// Store copies the FIT file into the archive unless it's already there and
+// returns the archived original.
+func (a activityArchive) Store(f activityFile) (activityFile, error) {
+	dst := a.OriginalPath(f.Key)
+	archived := activityFile{Path: dst, Key: f.Key}
+	if _, err := os.Stat(dst); err == nil {
+		return archived, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return archived, err
+	}
+	if err := copyFile(f.Path, dst); err != nil {
+		return archived, fmt.Errorf("archive %s: %w", filepath.Base(f.Path), err)
+	}
+	return archived, nil
+}
+
+// Snapshot archives every complete FIT file in the MyWhoosh directory that
+// isn't archived yet and returns how many it copied. Files that aren't
+// ready (see checkReady) are left for a later snapshot and returned in
+// deferred with the reason, keyed by path. A broken file is returned once;
+// later snapshots skip it until it changes.
+func (a activityArchive) Snapshot(dir string) (copied int, deferred map[string]error, err error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.fit"))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	broken := a.loadBroken()
+	brokenChanged := false
+	for path := range broken {
+		if filepath.Dir(path) == filepath.Clean(dir) && !slices.Contains(matches, path) {
+			delete(broken, path) // gone
+			brokenChanged = true
+		}
+	}
+	defer func() {
+		if brokenChanged && err == nil {
+			err = a.saveBroken(broken)
+		}
+	}()
+
+	deferred = map[string]error{}
+	now := time.Now()
+	for _, path := range matches {
+		info, statErr := os.Stat(path)
+		if b, ok := broken[path]; ok {
+			if statErr == nil && b.matches(info) {
+				continue
+			}
+			delete(broken, path) // changed: give it another chance
+			brokenChanged = true
+		}
+		key, err := checkReady(path, now)
+		if err != nil {
+			deferred[path] = err
+			if statErr == nil && !errors.Is(err, errNotReady) {
+				broken[path] = brokenFile{Size: info.Size(), ModTime: info.ModTime()}
+				brokenChanged = true
+			}
+			continue
+		}
+		if _, err := os.Stat(a.OriginalPath(key)); err == nil {
+			continue
+		}
+		if _, err := a.Store(activityFile{Path: path, Key: key}); err != nil {
+			return copied, deferred, err
+		}
+		copied++
+	}
+	return copied, deferred, nil
+}
+
+// brokenFile is a MyWhoosh file that stayed unreadable, as it was when it
+// was found broken.
+type brokenFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// matches reports whether the file is unchanged since it was found broken.
+func (b brokenFile) matches(info fs.FileInfo) bool {
+	return info.Size() == b.Size && info.ModTime().Equal(b.ModTime)
+}
+
+// brokenListPath is where the archive lists the broken MyWhoosh files,
+// keyed by path.
+func (a activityArchive) brokenListPath() string {
+	return filepath.Join(a.dir, "broken.json")
+}
+
+// loadBroken reads the list of broken files. A missing or unreadable list
+// is empty: the files are then reported once more.
+func (a activityArchive) loadBroken() map[string]brokenFile {
+	broken := map[string]brokenFile{}
+	if data, err := os.ReadFile(a.brokenListPath()); err == nil {
+		json.Unmarshal(data, &broken)
+	}
+	return broken
+}
+
+func (a activityArchive) saveBroken(broken map[string]brokenFile) error {
+	if err := os.MkdirAll(a.dir, 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(broken, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(a.brokenListPath(), data, 0o600)
+}
+
+// copyFile copies src to dst through a temporary file and keeps the
+// modification time of src.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// walkFitFiles calls fn for every original FIT file under dir, skipping
+// fixed versions and the YYYY and YYYY/MM directories of the archive that
+// hold nothing in rng.
+func walkFitFiles(dir string, rng dateRange, fn func(path string, info fs.FileInfo)) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if rel, err := filepath.Rel(dir, path); err == nil {
+				if from, to, ok := archiveSpan(rel); ok && !rng.Overlaps(from, to) {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".fit") || isFixedFile(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fn(path, info)
+		return nil
+	})
+}
+
+// archiveSpan returns the start times an archive directory can hold, given
+// its path relative to the archive: a year (2024) or a month (2024/05),
+// in UTC. ok is false for other directories.
+func archiveSpan(rel string) (from, to time.Time, ok bool) {
+	rel = filepath.ToSlash(rel)
+	var months int
+	var layout string
+	switch strings.Count(rel, "/") {
+	case 0:
+		layout, months = "2006", 12
+	case 1:
+		layout, months = "2006/01", 1
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	t, err := time.Parse(layout, rel)
+	if err != nil || t.Format(layout) != rel {
+		return time.Time{}, time.Time{}, false
+	}
+	return t, t.AddDate(0, months, 0), true
+}
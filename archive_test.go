@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ageTestFile sets the file's modification time a minute back, past the
+// stable window.
+func ageTestFile(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveSnapshot(t *testing.T) {
+	gameDir := t.TempDir()
+	archive := activityArchive{dir: t.TempDir()}
+	path := filepath.Join(gameDir, "MyNewActivity-3.8.5.fit")
+	createTestFitFile(t, path)
+	ageTestFile(t, path)
+
+	n, _, err := archive.Snapshot(gameDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("archived %d files, want 1", n)
+	}
+	key, err := readActivityKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := archive.OriginalPath(key)
+	start := key.Start.UTC()
+	wantDir := filepath.Join(archive.dir, start.Format("2006"), start.Format("01"))
+	if filepath.Dir(original) != wantDir {
+		t.Errorf("archived in %s, want %s", filepath.Dir(original), wantDir)
+	}
+	if !strings.HasPrefix(filepath.Base(original), start.Format("2006-01-02_150405")+"_") {
+		t.Errorf("archived as %s, want a name from the start time", filepath.Base(original))
+	}
+	if got, _ := fileSHA256(original); got != key.SHA256 {
+		t.Error("archived copy differs from the original")
+	}
+
+	if n, _, _ := archive.Snapshot(gameDir); n != 0 {
+		t.Errorf("second snapshot archived %d files, want 0", n)
+	}
+
+	// MyWhoosh overwrites the file with the next ride: both are kept.
+	rewriteTestFile(t, path, 250)
+	ageTestFile(t, path)
+	if n, _, _ := archive.Snapshot(gameDir); n != 1 {
+		t.Errorf("snapshot after overwrite archived %d files, want 1", n)
+	}
+	if _, err := os.Stat(original); err != nil {
+		t.Errorf("first ride lost from the archive: %v", err)
+	}
+
+	// Fixed versions aren't candidates for upload.
+	if err := fixFitFile(original, fixedPath(original)); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err := openLedger(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := findUnsyncedFitFiles(archive.dir, ledger, dateRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("found %d unsynced files in the archive, want 2", len(files))
+	}
+	for _, f := range files {
+		if isFixedFile(f.Path) {
+			t.Errorf("fixed file %s offered for upload", f.Path)
+		}
+	}
+}
+
+func TestArchiveSnapshotDefersIncompleteFiles(t *testing.T) {
+	gameDir := t.TempDir()
+	archive := activityArchive{dir: t.TempDir()}
+
+	fresh := filepath.Join(gameDir, "fresh.fit")
+	createTestFitFile(t, fresh)
+
+	data, err := os.ReadFile(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(gameDir, "truncated.fit")
+	if err := os.WriteFile(truncated, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ageTestFile(t, truncated)
+
+	n, deferred, err := archive.Snapshot(gameDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("archived %d files, want 0", n)
+	}
+	for _, path := range []string{fresh, truncated} {
+		if !errors.Is(deferred[path], errNotReady) {
+			t.Errorf("%s: got %v, want errNotReady", filepath.Base(path), deferred[path])
+		}
+	}
+
+	// A file that stays unreadable is broken, not still being written.
+	old := time.Now().Add(-2 * brokenAfter)
+	if err := os.Chtimes(truncated, old, old); err != nil {
+		t.Fatal(err)
+	}
+	_, deferred, _ = archive.Snapshot(gameDir)
+	if err := deferred[truncated]; err == nil || errors.Is(err, errNotReady) {
+		t.Errorf("old truncated file: got %v, want a plain error", err)
+	}
+
+	// It is reported once, and again only when it changes.
+	if _, deferred, _ = archive.Snapshot(gameDir); deferred[truncated] != nil {
+		t.Errorf("broken file reported again: %v", deferred[truncated])
+	}
+	older := old.Add(-time.Minute)
+	if err := os.Chtimes(truncated, older, older); err != nil {
+		t.Fatal(err)
+	}
+	if _, deferred, _ = archive.Snapshot(gameDir); deferred[truncated] == nil {
+		t.Error("changed broken file not checked again")
+	}
+
+	ageTestFile(t, fresh)
+	if n, _, _ := archive.Snapshot(gameDir); n != 1 {
+		t.Errorf("archived %d files once complete, want 1", n)
+	}
+}
+
+func TestFindUnsyncedSkipsOtherMonths(t *testing.T) {
+	dir := t.TempDir()
+	ledger, err := openLedger(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The ride started today, but its month directory says otherwise: only
+	// a scan that skips the directory misses it.
+	path := filepath.Join(dir, "2001", "01", "ride.fit")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	createTestFitFile(t, path)
+
+	if files, _ := findUnsyncedFitFiles(dir, ledger, lookbackRange(7, time.Now())); len(files) != 0 {
+		t.Errorf("last 7 days: found %d files in 2001/01, want 0", len(files))
+	}
+	if files, _ := findUnsyncedFitFiles(dir, ledger, dateRange{}); len(files) != 1 {
+		t.Errorf("all time: found %d files, want 1", len(files))
+	}
+
+	for _, tt := range []struct {
+		rel string
+		ok  bool
+	}{
+		{"2024", true},
+		{"2024/05", true},
+		{"undated", false},
+		{"2024/5", false},
+		{"2024/05/01", false},
+	} {
+		if _, _, ok := archiveSpan(tt.rel); ok != tt.ok {
+			t.Errorf("archiveSpan(%q) ok = %v, want %v", tt.rel, ok, tt.ok)
+		}
+	}
+}
+
+func TestOriginalPathIgnoresTimeZone(t *testing.T) {
+	archive := activityArchive{dir: "archive"}
+	key := activityKey{SHA256: "1a2b3c4d5e6f", Start: time.Date(2024, 5, 31, 23, 30, 0, 0, time.UTC)}
+	want := filepath.Join("archive", "2024", "05", "2024-05-31_233000_1a2b3c4d.fit")
+
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("CEST", 2*3600)} {
+		time.Local = loc
+		if got := archive.OriginalPath(key); got != want {
+			t.Errorf("in %s: got %s, want %s", loc, got, want)
+		}
+	}
+}
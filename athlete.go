@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+
+	"mywhoosh2garmin/garmin"
+)
+
+// ---------------------------------------------------------------------------
+// Athlete zones and user profile
+// ---------------------------------------------------------------------------
+
+// configured reports whether any athlete value is set.
+func (a athleteConfig) configured() bool {
+	return a.FTP != 0 || a.MaxHR != 0 || a.RestingHR != 0 || a.ThresholdHR != 0 || a.WeightKg != 0
+}
+
+// String describes the configured values for logs.
+func (a athleteConfig) String() string {
+	s := ""
+	add := func(format string, v interface{}) {
+		if s != "" {
+			s += ", "
+		}
+		s += fmt.Sprintf(format, v)
+	}
+	if a.FTP != 0 {
+		add("FTP %d W", a.FTP)
+	}
+	if a.MaxHR != 0 {
+		add("max HR %d", a.MaxHR)
+	}
+	if a.RestingHR != 0 {
+		add("resting HR %d", a.RestingHR)
+	}
+	if a.ThresholdHR != 0 {
+		add("threshold HR %d", a.ThresholdHR)
+	}
+	if a.WeightKg != 0 {
+		add("%.1f kg", a.WeightKg)
+	}
+	if s == "" {
+		return "nothing"
+	}
+	return s
+}
+
+// mergeGarmin fills the values a doesn't have from a Garmin Connect profile
+// and switches FetchFromGarmin off: the fetch happens once.
+func (a *athleteConfig) mergeGarmin(p *garmin.AthleteProfile) {
+	a.FetchFromGarmin = false
+	if a.FTP == 0 && p.FTP > 0 && p.FTP < math.MaxUint16 {
+		a.FTP = uint16(p.FTP)
+	}
+	if a.MaxHR == 0 && p.MaxHR > 0 && p.MaxHR < math.MaxUint8 {
+		a.MaxHR = uint8(p.MaxHR)
+	}
+	if a.RestingHR == 0 && p.RestingHR > 0 && p.RestingHR < math.MaxUint8 {
+		a.RestingHR = uint8(p.RestingHR)
+	}
+	if a.ThresholdHR == 0 && p.ThresholdHR > 0 && p.ThresholdHR < math.MaxUint8 {
+		a.ThresholdHR = uint8(p.ThresholdHR)
+	}
+	if a.WeightKg == 0 && p.WeightKg > 0 {
+		a.WeightKg = math.Round(p.WeightKg*10) / 10
+	}
+}
+
+// athleteFixer writes the configured thresholds and weight into the
+// zones_target and user_profile messages, which Garmin uses to compute
+// training effect and load.
+type athleteFixer struct {
+	athlete athleteConfig
+}
+
+func (f *athleteFixer) Name() string { return "athlete-profile" }
+
+func (f *athleteFixer) Fix(activity *filedef.Activity) ([]string, error) {
+	a := f.athlete
+	if !a.configured() {
+		return nil, nil
+	}
+	var changes []string
+
+	if len(activity.ZonesTargets) == 0 {
+		activity.ZonesTargets = append(activity.ZonesTargets, mesgdef.NewZonesTarget(nil))
+		changes = append(changes, "zones_target added")
+	}
+	for _, zt := range activity.ZonesTargets {
+		if a.FTP != 0 && zt.FunctionalThresholdPower != a.FTP {
+			zt.FunctionalThresholdPower = a.FTP
+			zt.PwrCalcType = typedef.PwrZoneCalcPercentFtp
+			changes = append(changes, fmt.Sprintf("threshold power: %d W", a.FTP))
+		}
+		if a.MaxHR != 0 && zt.MaxHeartRate != a.MaxHR {
+			zt.MaxHeartRate = a.MaxHR
+			zt.HrCalcType = typedef.HrZoneCalcPercentMaxHr
+			changes = append(changes, fmt.Sprintf("max heart rate: %d bpm", a.MaxHR))
+		}
+		if a.ThresholdHR != 0 && zt.ThresholdHeartRate != a.ThresholdHR {
+			zt.ThresholdHeartRate = a.ThresholdHR
+			changes = append(changes, fmt.Sprintf("threshold HR:   %d bpm", a.ThresholdHR))
+		}
+	}
+
+	if activity.UserProfile == nil {
+		activity.UserProfile = mesgdef.NewUserProfile(nil)
+		changes = append(changes, "user_profile added")
+	}
+	up := activity.UserProfile
+	if a.WeightKg != 0 {
+		if w := uint16(math.Round(a.WeightKg * 10)); up.Weight != w {
+			up.Weight = w
+			changes = append(changes, fmt.Sprintf("weight:         %.1f kg", a.WeightKg))
+		}
+	}
+	if a.MaxHR != 0 && (up.DefaultMaxHeartRate != a.MaxHR || up.DefaultMaxBikingHeartRate != a.MaxHR) {
+		up.DefaultMaxHeartRate = a.MaxHR
+		up.DefaultMaxBikingHeartRate = a.MaxHR
+		changes = append(changes, fmt.Sprintf("profile max HR: %d bpm", a.MaxHR))
+	}
+	if a.RestingHR != 0 && up.RestingHeartRate != a.RestingHR {
+		up.RestingHeartRate = a.RestingHR
+		changes = append(changes, fmt.Sprintf("resting HR:     %d bpm", a.RestingHR))
+	}
+
+	if a.FTP != 0 {
+		for i, sess := range activity.Sessions {
+			if sess.ThresholdPower != a.FTP {
+				sess.ThresholdPower = a.FTP
+				changes = append(changes, fmt.Sprintf("session %d FTP:  %d W", i+1, a.FTP))
+			}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+
+	"mywhoosh2garmin/garmin"
+)
+
+func TestAthleteFixer(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.Sessions = append(activity.Sessions, mesgdef.NewSession(nil))
+
+	f := &athleteFixer{athlete: athleteConfig{FTP: 260, MaxHR: 188, ThresholdHR: 170, WeightKg: 72.5}}
+	changes, err := f.Fix(activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Fatal("no changes reported")
+	}
+
+	if len(activity.ZonesTargets) != 1 {
+		t.Fatalf("got %d zones_target messages, want 1", len(activity.ZonesTargets))
+	}
+	zt := activity.ZonesTargets[0]
+	if zt.FunctionalThresholdPower != 260 || zt.PwrCalcType != typedef.PwrZoneCalcPercentFtp {
+		t.Errorf("zones_target power: %d / %s", zt.FunctionalThresholdPower, zt.PwrCalcType)
+	}
+	if zt.MaxHeartRate != 188 || zt.ThresholdHeartRate != 170 {
+		t.Errorf("zones_target HR: max %d threshold %d", zt.MaxHeartRate, zt.ThresholdHeartRate)
+	}
+	if activity.UserProfile == nil || activity.UserProfile.Weight != 725 {
+		t.Errorf("user_profile weight: %+v", activity.UserProfile)
+	}
+	if activity.Sessions[0].ThresholdPower != 260 {
+		t.Errorf("session threshold power: %d", activity.Sessions[0].ThresholdPower)
+	}
+
+	// Stale values are replaced, and a second run changes nothing.
+	zt.FunctionalThresholdPower = 200
+	f.Fix(activity)
+	if zt.FunctionalThresholdPower != 260 {
+		t.Errorf("stale FTP kept: %d", zt.FunctionalThresholdPower)
+	}
+	if changes, _ := f.Fix(activity); len(changes) != 0 {
+		t.Errorf("second run changed %v", changes)
+	}
+
+	// Every edit is reported, so a dry run shows it.
+	activity.Sessions[0].ThresholdPower = 200
+	activity.UserProfile.DefaultMaxHeartRate = 180
+	if changes, _ := f.Fix(activity); len(changes) != 2 {
+		t.Errorf("stale session FTP and profile max HR: reported %q, want 2 changes", changes)
+	}
+}
+
+func TestAthleteFixerUnconfigured(t *testing.T) {
+	activity := filedef.NewActivity()
+	changes, _ := (&athleteFixer{}).Fix(activity)
+	if len(changes) != 0 || activity.UserProfile != nil || len(activity.ZonesTargets) != 0 {
+		t.Error("unconfigured athlete should leave the file alone")
+	}
+}
+
+func TestAthleteMergeGarmin(t *testing.T) {
+	a := athleteConfig{FTP: 250, FetchFromGarmin: true}
+	a.mergeGarmin(&garmin.AthleteProfile{FTP: 300, MaxHR: 190, WeightKg: 71.04})
+
+	if a.FTP != 250 {
+		t.Errorf("configured FTP overwritten: %d", a.FTP)
+	}
+	if a.MaxHR != 190 || a.WeightKg != 71 {
+		t.Errorf("unset values not filled: %+v", a)
+	}
+	if a.FetchFromGarmin {
+		t.Error("fetch should switch itself off")
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"mywhoosh2garmin/garmin"
+)
+
+// ---------------------------------------------------------------------------
+// Command line (headless) mode
+// ---------------------------------------------------------------------------
+
+// Exit codes for command line mode. A run where some files failed exits
+// with the number of failed files, capped at exitMaxFailed.
+const (
+	exitOK        = 0
+	exitMaxFailed = 63
+	exitUsage     = 64  // bad flags or arguments
+	exitFatal     = 69  // the run couldn't start (scan, login, …)
+	exitInterrupt = 130 // interrupted (Ctrl-C) before the sync finished
+)
+
+const usageText = `Usage: mywhoosh2garmin [command] [flags]
+
+Without a command the GUI is started.
+
+Commands:
+  sync    fix and upload unsynced MyWhoosh activities to Garmin Connect
+  watch   sync every new ride as soon as MyWhoosh has written it
+  dirs    list the MyWhoosh directories found and choose which to sync
+  fix     fix FIT files without uploading them
+  help    show this help
+
+Run "mywhoosh2garmin <command> -h" for the flags of a command.
+
+Exit codes:
+  0       success
+  1-63    number of files that failed (capped at 63)
+  64      usage error
+  69      the run couldn't start (scan or login failed)
+  130     interrupted (Ctrl-C); the remaining files are synced next time
+`
+
+// runCLI runs the subcommand named by args[0]. ok is false when args don't
+// name a subcommand, in which case the GUI should start instead.
+func runCLI(args []string) (code int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch args[0] {
+	case "sync":
+		return cmdSync(args[1:]), true
+	case "watch":
+		return cmdWatch(args[1:]), true
+	case "dirs":
+		return cmdDirs(args[1:]), true
+	case "fix":
+		return cmdFix(args[1:]), true
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usageText)
+		return exitOK, true
+	}
+
+	// Unknown flags/arguments (e.g. -psn_* on macOS) are left to the GUI.
+	if strings.HasPrefix(args[0], "-") {
+		return 0, false
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], usageText)
+	return exitUsage, true
+}
+
+// syncFlags are the flags shared by sync and watch.
+type syncFlags struct {
+	dirs            []string
+	email, password *string
+	since, until    *string
+	backfill        *bool
+	throttle        *time.Duration
+	save            *bool
+}
+
+// registerSyncFlags binds the sync flags and the fix flags to fs.
+func registerSyncFlags(fs *flag.FlagSet, cfg *appConfig) *syncFlags {
+	f := &syncFlags{
+		dirs:  cfg.MyWhooshDirs,
+		email: fs.String("email", cfg.Email, "Garmin Connect email"),
+		password: fs.String("password", os.Getenv("MYWHOOSH2GARMIN_PASSWORD"),
+			"Garmin Connect password (default $MYWHOOSH2GARMIN_PASSWORD, prompted if needed)"),
+		since: fs.String("since", "", fmt.Sprintf(
+			"only sync activities started at or after this `time`: YYYY-MM-DD, RFC 3339 or an age like 7d (default %s)",
+			lookbackText(cfg.LookbackDays))),
+		until:    fs.String("until", "", "only sync activities started before this `time` (a date includes that day)"),
+		backfill: fs.Bool("backfill", false, "sync the whole history (or -since/-until), pausing between uploads"),
+		throttle: fs.Duration("throttle", 0,
+			fmt.Sprintf("pause between uploads (default %s with -backfill)", backfillThrottle)),
+		save: fs.Bool("save", false, "remember -dir and -email in the config file"),
+	}
+	fs.Var(&dirsFlag{dirs: &f.dirs}, "dir", "MyWhoosh FIT file `directory` (repeatable)")
+	registerFixFlags(fs, &cfg.Fix)
+	return f
+}
+
+// newSyncer checks the parsed flags and builds the syncer. When ok is false
+// the command should return code right away.
+func (f *syncFlags) newSyncer(fs *flag.FlagSet, cfg appConfig) (s *syncer, code int, ok bool) {
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments: %v\n", fs.Name(), fs.Args())
+		return nil, exitUsage, false
+	}
+	if err := cfg.Fix.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Name(), err)
+		return nil, exitUsage, false
+	}
+
+	now := time.Now()
+	rng := lookbackRange(cfg.LookbackDays, now)
+	if *f.backfill {
+		rng = dateRange{}
+	}
+	if *f.since != "" {
+		t, err := parseRangeTime(*f.since, now, false)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: -since: %v\n", fs.Name(), err)
+			return nil, exitUsage, false
+		}
+		rng.Since = t
+	}
+	if *f.until != "" {
+		t, err := parseRangeTime(*f.until, now, true)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: -until: %v\n", fs.Name(), err)
+			return nil, exitUsage, false
+		}
+		rng.Until = t
+	}
+	throttle := *f.throttle
+	if *f.backfill && !flagSet(fs, "throttle") {
+		throttle = backfillThrottle
+	}
+
+	if *f.save {
+		saved := loadAppConfig()
+		saved.MyWhooshDirs = f.dirs
+		saved.Email = *f.email
+		saveAppConfig(saved)
+	}
+
+	email := *f.email
+	s = &syncer{
+		Dirs:       f.dirs,
+		Email:      email,
+		Password:   *f.password,
+		TokenDir:   appConfigDir(),
+		LedgerPath: ledgerPath(),
+		ArchiveDir: archiveDir(),
+		Range:      rng,
+		Throttle:   throttle,
+		Fix:        cfg.Fix,
+		SaveAthleteProfile: func(p *garmin.AthleteProfile) {
+			saved := loadAppConfig()
+			saved.Fix.Athlete.mergeGarmin(p)
+			saveAppConfig(saved)
+		},
+		PromptPassword: func(ctx context.Context) (string, error) {
+			return promptPassword(ctx, os.Stderr, "Garmin password for "+email+": ")
+		},
+		Log: func(msg string) { fmt.Println(msg) },
+	}
+	if stdinIsTerminal() {
+		// Without anyone to answer, an MFA challenge fails the login
+		// with ErrMFARequired instead of reading EOF
+		s.PromptMFA = func(ctx context.Context) (string, error) {
+			return promptLine(ctx, stdin, os.Stderr, "Garmin MFA code: ")
+		}
+	}
+	return s, 0, true
+}
+
+// cmdSync implements "mywhoosh2garmin sync".
+func cmdSync(args []string) int {
+	cfg := loadAppConfig()
+
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	sf := registerSyncFlags(fs, &cfg)
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	s, code, ok := sf.newSyncer(fs, cfg)
+	if !ok {
+		return code
+	}
+	queue, err := openRetryQueue(retryQueuePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sync: retry queue: %v\n", err)
+		return exitFatal
+	}
+	s.Retry = queue
+
+	ctx, stop := interruptContext()
+	defer stop()
+	res, err := s.Run(ctx)
+	if errors.Is(err, context.Canceled) {
+		return exitInterrupt
+	}
+	if err != nil {
+		return exitFatal
+	}
+	return failedExitCode(res.Failed)
+}
+
+// interruptContext returns a context that is cancelled by Ctrl-C or
+// SIGTERM. Only the first signal is caught: a second one kills the
+// process as usual, should winding down hang.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
+
+// cmdWatch implements "mywhoosh2garmin watch". It runs until interrupted.
+func cmdWatch(args []string) int {
+	cfg := loadAppConfig()
+
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	sf := registerSyncFlags(fs, &cfg)
+	debounce := fs.Duration("debounce", defaultDebounce,
+		"how long a file must stay unchanged before it is synced")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	s, code, ok := sf.newSyncer(fs, cfg)
+	if !ok {
+		return code
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	w := &watcher{Syncer: s, Debounce: *debounce, QueuePath: retryQueuePath()}
+	if err := w.Run(ctx); err != nil {
+		return exitFatal
+	}
+	return exitOK
+}
+
+// cmdDirs implements "mywhoosh2garmin dirs".
+func cmdDirs(args []string) int {
+	cfg := loadAppConfig()
+
+	fs := flag.NewFlagSet("dirs", flag.ContinueOnError)
+	use := fs.String("use", "", "sync from the listed directories `N[,N…]`, or all, and save the choice")
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "dirs: unexpected arguments: %v\n", fs.Args())
+		return exitUsage
+	}
+
+	candidates, err := findDirCandidates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dirs: %v\n", err)
+		return exitFatal
+	}
+
+	if *use == "" {
+		for i, c := range candidates {
+			mark := " "
+			if slices.Contains(cfg.MyWhooshDirs, c.Path) {
+				mark = "*"
+			}
+			fmt.Printf("%s %d. %s\n", mark, i+1, c)
+		}
+		fmt.Println("\n* = synced. Choose with: mywhoosh2garmin dirs -use 1,2")
+		return exitOK
+	}
+
+	dirs, err := pickCandidates(candidates, *use)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dirs: -use: %v\n", err)
+		return exitUsage
+	}
+	cfg.MyWhooshDirs = dirs
+	saveAppConfig(cfg)
+	for _, dir := range dirs {
+		fmt.Println("✓ Syncing from " + dir)
+	}
+	return exitOK
+}
+
+// pickCandidates returns the directories chosen by a 1-based list such as
+// "1,3", or "all".
+func pickCandidates(candidates []dirCandidate, sel string) ([]string, error) {
+	var dirs []string
+	if sel == "all" {
+		for _, c := range candidates {
+			dirs = append(dirs, c.Path)
+		}
+		return dirs, nil
+	}
+	for _, part := range strings.Split(sel, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 || n > len(candidates) {
+			return nil, fmt.Errorf("%q is not a directory number between 1 and %d", part, len(candidates))
+		}
+		if dir := candidates[n-1].Path; !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// dirsFlag is a repeatable flag.Value for a list of directories. The first
+// use replaces the default list.
+type dirsFlag struct {
+	dirs *[]string
+	set  bool
+}
+
+func (f *dirsFlag) String() string {
+	if f.dirs == nil {
+		return ""
+	}
+	return strings.Join(*f.dirs, ", ")
+}
+
+func (f *dirsFlag) Set(v string) error {
+	if !f.set {
+		*f.dirs = nil
+		f.set = true
+	}
+	*f.dirs = append(*f.dirs, v)
+	return nil
+}
+
+// cmdFix implements "mywhoosh2garmin fix".
+func cmdFix(args []string) int {
+	cfg := loadAppConfig()
+
+	fs := flag.NewFlagSet("fix", flag.ContinueOnError)
+	output := fs.String("o", "",
+		"output `path`: a file, a directory, or - for stdout (default: next to each input, stdout for stdin)")
+	dryRun := fs.Bool("dry-run", false, "only report what would change, write nothing")
+	registerFixFlags(fs, &cfg.Fix)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: mywhoosh2garmin fix [flags] input.fit... (- reads stdin)")
+		fs.PrintDefaults()
+	}
+	if code, ok := parseFlags(fs, args); !ok {
+		return code
+	}
+
+	inputs := fs.Args()
+	if len(inputs) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if err := cfg.Fix.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "fix: %v\n", err)
+		return exitUsage
+	}
+	stdinCount := 0
+	for _, in := range inputs {
+		if in == "-" {
+			stdinCount++
+		}
+	}
+	if stdinCount > 1 || (*output == "-" && len(inputs) > 1) {
+		fmt.Fprintln(os.Stderr, "fix: stdin and stdout can only be used with a single file")
+		return exitUsage
+	}
+	if len(inputs) > 1 && !isOutputDir(*output) {
+		fmt.Fprintf(os.Stderr, "fix: -o %s must be a directory when fixing several files\n", *output)
+		return exitUsage
+	}
+
+	// Log to stderr: stdout may carry the fixed FIT data.
+	logFn = func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+
+	pipeline := newFixPipeline(cfg.Fix)
+	toDir := *output != "" && *output != "-" &&
+		(len(inputs) > 1 || isDir(*output) || strings.HasSuffix(*output, string(os.PathSeparator)))
+	if toDir && !*dryRun {
+		if err := os.MkdirAll(*output, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "fix: %v\n", err)
+			return exitFatal
+		}
+	}
+
+	failed := 0
+	for _, in := range inputs {
+		out := fixOutputPath(in, *output, toDir)
+		logFn("%s\n", displayPath(in, "<stdin>"))
+		if err := fixStream(pipeline, in, out, *dryRun); err != nil {
+			logFn("  ❌ %v\n", err)
+			failed++
+			continue
+		}
+		if *dryRun {
+			logFn("  (dry run) would write %s\n", displayPath(out, "<stdout>"))
+		} else {
+			logFn("  ✓ wrote %s\n", displayPath(out, "<stdout>"))
+		}
+	}
+	return failedExitCode(failed)
+}
+
+// isOutputDir reports whether -o output can take several fixed files: it
+// is unset, an existing directory, or a new path that doesn't look like a
+// FIT file.
+func isOutputDir(output string) bool {
+	if output == "" || isDir(output) {
+		return true
+	}
+	if _, err := os.Stat(output); err == nil {
+		return false
+	}
+	return !strings.EqualFold(filepath.Ext(output), ".fit")
+}
+
+// fixOutputPath picks where "fix" writes the fixed version of in.
+func fixOutputPath(in, output string, toDir bool) string {
+	name := "activity.fit"
+	if in != "-" {
+		name = in
+	}
+	switch {
+	case toDir:
+		return filepath.Join(output, generateOutputFilename(name))
+	case output != "":
+		return output
+	case in == "-":
+		return "-"
+	default:
+		return filepath.Join(filepath.Dir(in), generateOutputFilename(in))
+	}
+}
+
+// fixStream fixes the FIT file at in (- for stdin) and writes it to out
+// (- for stdout). With dryRun the fixes are only logged.
+func fixStream(pipeline fixPipeline, in, out string, dryRun bool) error {
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	activity, err := decodeActivity(r)
+	if err != nil {
+		return err
+	}
+	if _, err := pipeline.Run(activity); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	if out == "-" {
+		return encodeActivity(os.Stdout, activity)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := encodeActivity(f, activity); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// displayPath returns p for log output, or std when p is "-".
+func displayPath(p, std string) string {
+	if p == "-" {
+		return std
+	}
+	return p
+}
+
+// parseFlags parses args into fs. When ok is false the command should
+// return code right away (-h was given, or the flags were invalid).
+func parseFlags(fs *flag.FlagSet, args []string) (code int, ok bool) {
+	err := fs.Parse(args)
+	switch {
+	case err == nil:
+		return 0, true
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK, false
+	default:
+		return exitUsage, false
+	}
+}
+
+// flagSet reports whether the flag was given on the command line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// failedExitCode maps a number of failed files to an exit code.
+func failedExitCode(failed int) int {
+	return min(failed, exitMaxFailed)
+}
+
+// stdin is the one buffered reader on standard input. Prompts share it, so
+// piped answers aren't lost to the buffer of an earlier prompt.
+var stdin = bufio.NewReader(os.Stdin)
+
+// promptLine prints label to w and reads one line from r, or gives up
+// when ctx is done.
+func promptLine(ctx context.Context, r *bufio.Reader, w io.Writer, label string) (string, error) {
+	fmt.Fprint(w, label)
+	line, err := readContext(ctx, w, func() (string, error) { return r.ReadString('\n') })
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stdinIsTerminal reports whether standard input is a terminal, i.e.
+// someone can answer prompts.
+func stdinIsTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// promptPassword prints label to w and reads a password from the terminal
+// without echoing it, or gives up when ctx is done. When standard input
+// isn't a terminal it reads a line.
+func promptPassword(ctx context.Context, w io.Writer, label string) (string, error) {
+	if !stdinIsTerminal() {
+		return promptLine(ctx, stdin, w, label)
+	}
+	fd := int(os.Stdin.Fd())
+	state, err := term.GetState(fd)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(w, label)
+	password, err := readContext(ctx, w, func() (string, error) {
+		p, err := term.ReadPassword(fd)
+		return string(p), err
+	})
+	if err != nil && ctx.Err() != nil {
+		term.Restore(fd, state) // echo back on for the shell
+		return "", err
+	}
+	fmt.Fprintln(w)
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// readContext returns what read returns, or ctx.Err() as soon as ctx is
+// done, ending the prompt line on w. An abandoned read goes on blocking in
+// the background; the process is about to exit anyway.
+func readContext(ctx context.Context, w io.Writer, read func() (string, error)) (string, error) {
+	type answer struct {
+		s   string
+		err error
+	}
+	done := make(chan answer, 1)
+	go func() {
+		s, err := read()
+		done <- answer{s, err}
+	}()
+	select {
+	case a := <-done:
+		return a.s, a.err
+	case <-ctx.Done():
+		fmt.Fprintln(w)
+		return "", ctx.Err()
+	}
+}
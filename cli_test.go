@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCLIDispatch(t *testing.T) {
+	if _, ok := runCLI(nil); ok {
+		t.Error("no args: expected GUI mode")
+	}
+	if _, ok := runCLI([]string{"-psn_0_12345"}); ok {
+		t.Error("unknown flag: expected GUI mode")
+	}
+	if code, ok := runCLI([]string{"bogus"}); !ok || code != exitUsage {
+		t.Errorf("unknown command: got (%d, %v), want (%d, true)", code, ok, exitUsage)
+	}
+}
+
+func TestFailedExitCode(t *testing.T) {
+	tests := []struct{ failed, want int }{
+		{0, exitOK},
+		{3, 3},
+		{500, exitMaxFailed},
+	}
+	for _, tt := range tests {
+		if got := failedExitCode(tt.failed); got != tt.want {
+			t.Errorf("failedExitCode(%d) = %d, want %d", tt.failed, got, tt.want)
+		}
+	}
+}
+
+func TestPromptLine(t *testing.T) {
+	var out strings.Builder
+	r := bufio.NewReader(strings.NewReader("secret\r\n123456\n"))
+	got, err := promptLine(context.Background(), r, &out, "Password: ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "secret" {
+		t.Errorf("got %q, want %q", got, "secret")
+	}
+	if out.String() != "Password: " {
+		t.Errorf("prompt: got %q", out.String())
+	}
+
+	// A second prompt on the same reader gets the next line.
+	if got, _ := promptLine(context.Background(), r, &out, "Code: "); got != "123456" {
+		t.Errorf("second prompt: got %q, want %q", got, "123456")
+	}
+
+	// Ctrl-C at a prompt doesn't wait for Enter.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := promptLine(ctx, bufio.NewReader(pr), &out, "Code: "); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled prompt: got %v, want context.Canceled", err)
+	}
+}
+
+func TestSyncerPromptsMFAOnlyOnTerminal(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	if stdinIsTerminal() {
+		t.Skip("standard input is a terminal")
+	}
+	cfg := loadAppConfig()
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	sf := registerSyncFlags(fs, &cfg)
+	if err := fs.Parse([]string{"--email", "rider@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	s, _, ok := sf.newSyncer(fs, cfg)
+	if !ok {
+		t.Fatal("newSyncer failed")
+	}
+	if s.PromptMFA != nil {
+		t.Error("MFA prompt set without a terminal to answer it")
+	}
+}
+
+func TestFixRejectsFileOutputForSeveralInputs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.fit")
+	if code := cmdFix([]string{"-o", out, "a.fit", "b.fit"}); code != exitUsage {
+		t.Errorf("exit code %d, want %d", code, exitUsage)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("created the output")
+	}
+
+	existing := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(existing, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if isOutputDir(existing) {
+		t.Error("an existing file taken for an output directory")
+	}
+	if !isOutputDir(filepath.Join(dir, "fixed")) || !isOutputDir(dir) || !isOutputDir("") {
+		t.Error("a directory rejected as output")
+	}
+}
+
+func TestFixOutputPath(t *testing.T) {
+	if got := fixOutputPath("-", "", false); got != "-" {
+		t.Errorf("stdin without -o: got %q, want stdout", got)
+	}
+	if got := fixOutputPath("in.fit", "out.fit", false); got != "out.fit" {
+		t.Errorf("explicit file: got %q", got)
+	}
+	got := fixOutputPath(filepath.Join("a", "MyNewActivity-3.8.5.fit"), "out", true)
+	if filepath.Dir(got) != "out" || !strings.HasPrefix(filepath.Base(got), "MyNewActivity-3.8.5_") {
+		t.Errorf("directory output: got %q", got)
+	}
+	got = fixOutputPath(filepath.Join("a", "MyNewActivity-3.8.5.fit"), "", false)
+	if filepath.Dir(got) != "a" {
+		t.Errorf("default output should sit next to the input: got %q", got)
+	}
+}
+
+func TestFixStreamDryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit")
+	outputPath := filepath.Join(tmpDir, "fixed.fit")
+	createTestFitFile(t, inputPath)
+	pipeline := newFixPipeline(defaultFixConfig())
+
+	if err := fixStream(pipeline, inputPath, outputPath, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote %s", outputPath)
+	}
+
+	if err := fixStream(pipeline, inputPath, outputPath, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputPath); err != nil {
+		t.Errorf("output not written: %v", err)
+	}
+}
+
+func TestPickCandidates(t *testing.T) {
+	candidates := []dirCandidate{{Path: "a"}, {Path: "b"}, {Path: "c"}}
+
+	got, err := pickCandidates(candidates, "3, 1,3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, ",") != "c,a" {
+		t.Errorf("got %v, want [c a]", got)
+	}
+	if got, _ := pickCandidates(candidates, "all"); len(got) != 3 {
+		t.Errorf("all: got %v", got)
+	}
+	for _, sel := range []string{"0", "4", "x", ""} {
+		if _, err := pickCandidates(candidates, sel); err == nil {
+			t.Errorf("%q: expected error", sel)
+		}
+	}
+}
+
+func TestDirsFlag(t *testing.T) {
+	dirs := []string{"saved"}
+	f := &dirsFlag{dirs: &dirs}
+	f.Set("one")
+	f.Set("two")
+	if strings.Join(dirs, ",") != "one,two" {
+		t.Errorf("got %v, want the flag values to replace the default", dirs)
+	}
+}
@@ -43,8 +43,9 @@ func main() {
 
 	fmt.Printf("\n=== device_info (%d messages) ===\n", len(activity.DeviceInfos))
 	for i, di := range activity.DeviceInfos {
-		fmt.Printf("[%d] Manufacturer: %d (%s), Product: %d, Serial: %d, DeviceIndex: %d\n",
-			i, di.Manufacturer, di.Manufacturer, di.Product, di.SerialNumber, di.DeviceIndex)
+		fmt.Printf("[%d] Manufacturer: %d (%s), Product: %d, Serial: %d, DeviceIndex: %d, Source: %s, DeviceType: %d\n",
+			i, di.Manufacturer, di.Manufacturer, di.Product, di.SerialNumber, di.DeviceIndex,
+			di.SourceType, di.DeviceType)
 	}
 
 	fmt.Printf("\n=== sessions (%d) ===\n", len(activity.Sessions))
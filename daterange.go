@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Activity date ranges (--since/--until)
+// ---------------------------------------------------------------------------
+
+const (
+	// defaultLookbackDays is how far back a sync looks by default.
+	defaultLookbackDays = 30
+
+	// backfillThrottle is the default pause between uploads when syncing
+	// a whole history, to stay clear of Garmin's rate limits.
+	backfillThrottle = 30 * time.Second
+)
+
+// lookbackText describes a lookback of days days for humans.
+func lookbackText(days int) string {
+	if days <= 0 {
+		return "all time"
+	}
+	return fmt.Sprintf("the last %d days", days)
+}
+
+// dateRange selects activities by their start time. A zero Since or Until
+// leaves that side open; Until is exclusive.
+type dateRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+// lookbackRange returns the range of the last days days, or all time for
+// zero days.
+func lookbackRange(days int, now time.Time) dateRange {
+	if days <= 0 {
+		return dateRange{}
+	}
+	return dateRange{Since: now.AddDate(0, 0, -days)}
+}
+
+// Contains reports whether t is in the range.
+func (r dateRange) Contains(t time.Time) bool {
+	if !r.Since.IsZero() && t.Before(r.Since) {
+		return false
+	}
+	if !r.Until.IsZero() && !t.Before(r.Until) {
+		return false
+	}
+	return true
+}
+
+// Overlaps reports whether any time from from up to to is in the range.
+func (r dateRange) Overlaps(from, to time.Time) bool {
+	if !r.Since.IsZero() && !to.After(r.Since) {
+		return false
+	}
+	if !r.Until.IsZero() && !from.Before(r.Until) {
+		return false
+	}
+	return true
+}
+
+// IsBackfill reports whether syncing the range calls for backfillThrottle:
+// it has no start, or spans more than the default lookback.
+func (r dateRange) IsBackfill(now time.Time) bool {
+	if r.Since.IsZero() {
+		return true
+	}
+	end := r.Until
+	if end.IsZero() || end.After(now) {
+		end = now
+	}
+	return end.Sub(r.Since) > defaultLookbackDays*24*time.Hour
+}
+
+func (r dateRange) String() string {
+	const layout = "2006-01-02 15:04"
+	switch {
+	case r.Since.IsZero() && r.Until.IsZero():
+		return "all time"
+	case r.Until.IsZero():
+		return "since " + r.Since.Format(layout)
+	case r.Since.IsZero():
+		return "before " + r.Until.Format(layout)
+	default:
+		return r.Since.Format(layout) + " to " + r.Until.Format(layout)
+	}
+}
+
+// parseRangeTime parses a --since/--until value: a date (2006-01-02), an
+// RFC 3339 time, or an age such as 7d or 36h counted back from now. With
+// endOfDay a date means the end of that day, so --until 2024-05-31
+// includes the 31st.
+func parseRangeTime(v string, now time.Time, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want YYYY-MM-DD, an RFC 3339 time, or an age like 7d or 36h", v)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRangeTime(t *testing.T) {
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		in       string
+		endOfDay bool
+		want     time.Time
+	}{
+		{"2024-05-01", false, time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-05-01", true, time.Date(2024, 5, 2, 0, 0, 0, 0, time.Local)},
+		{"2024-05-01T08:30:00Z", false, time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC)},
+		{"7d", false, now.AddDate(0, 0, -7)},
+		{"36h", false, now.Add(-36 * time.Hour)},
+	}
+	for _, tt := range tests {
+		got, err := parseRangeTime(tt.in, now, tt.endOfDay)
+		if err != nil {
+			t.Errorf("parseRangeTime(%q): %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseRangeTime(%q, %v) = %s, want %s", tt.in, tt.endOfDay, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "yesterday", "-3d", "2024-13-01"} {
+		if _, err := parseRangeTime(in, now, false); err == nil {
+			t.Errorf("parseRangeTime(%q): expected error", in)
+		}
+	}
+}
+
+func TestDateRangeContains(t *testing.T) {
+	may := func(day int) time.Time { return time.Date(2024, 5, day, 0, 0, 0, 0, time.UTC) }
+	r := dateRange{Since: may(10), Until: may(20)}
+	for _, tt := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{may(9), false},
+		{may(10), true},
+		{may(19), true},
+		{may(20), false},
+	} {
+		if got := r.Contains(tt.t); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+	if !(dateRange{}).Contains(may(1)) {
+		t.Error("open range should contain everything")
+	}
+	if got := lookbackRange(0, may(20)); got != (dateRange{}) {
+		t.Errorf("lookbackRange(0) = %v, want all time", got)
+	}
+}
+
+func TestDateRangeIsBackfill(t *testing.T) {
+	now := time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name string
+		r    dateRange
+		want bool
+	}{
+		{"all time", dateRange{}, true},
+		{"before a date", dateRange{Until: now}, true},
+		{"one day", dateRange{Since: now.AddDate(0, 0, -1)}, false},
+		{"default lookback", lookbackRange(defaultLookbackDays, now), false},
+		{"a year", dateRange{Since: now.AddDate(-1, 0, 0)}, true},
+		{"a year ago, one week", dateRange{Since: now.AddDate(-1, 0, 0), Until: now.AddDate(-1, 0, 7)}, false},
+	} {
+		if got := tt.r.IsBackfill(now); got != tt.want {
+			t.Errorf("%s: IsBackfill = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindUnsyncedFitFilesRange(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit")
+	createTestFitFile(t, path)
+
+	// An old modification time doesn't hide a ride that started recently.
+	old := time.Now().AddDate(-1, 0, 0)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := openLedger(filepath.Join(tmpDir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := findUnsyncedFitFiles(tmpDir, ledger, lookbackRange(7, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("last 7 days: found %d files, want 1", len(files))
+	}
+
+	files, err = findUnsyncedFitFiles(tmpDir, ledger, dateRange{Until: time.Now().AddDate(0, 0, -1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("until yesterday: found %d files, want 0", len(files))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+)
+
+// ---------------------------------------------------------------------------
+// Device spoofing
+// ---------------------------------------------------------------------------
+
+// spoofProfile is a device identity the activity can be attributed to.
+type spoofProfile struct {
+	ID              string // key used in config and flags
+	Name            string // product name, shown in the GUI and written to the file
+	Manufacturer    typedef.Manufacturer
+	Product         uint16
+	SoftwareVersion uint16 // scaled by 100 (2680 = 26.80); 0 leaves it untouched
+}
+
+// customProfileID selects a profile built from deviceConfig.ProductID.
+const customProfileID = "custom"
+
+const defaultProfileID = "fenix6s"
+
+// spoofProfiles is the catalogue of selectable devices.
+var spoofProfiles = []spoofProfile{
+	{"fenix6s", "Garmin Fenix 6S Pro", typedef.ManufacturerGarmin, typedef.GarminProductFenix6s.Uint16(), 2680},
+	{"fenix7", "Garmin Fenix 7", typedef.ManufacturerGarmin, typedef.GarminProductFenix7.Uint16(), 2028},
+	{"fenix8", "Garmin Fenix 8", typedef.ManufacturerGarmin, typedef.GarminProductFenix8.Uint16(), 1334},
+	{"fr255", "Garmin Forerunner 255", typedef.ManufacturerGarmin, typedef.GarminProductFr255.Uint16(), 2026},
+	{"fr265", "Garmin Forerunner 265", typedef.ManufacturerGarmin, typedef.GarminProductFr265Large.Uint16(), 2026},
+	{"fr955", "Garmin Forerunner 955", typedef.ManufacturerGarmin, typedef.GarminProductFr955.Uint16(), 2026},
+	{"fr965", "Garmin Forerunner 965", typedef.ManufacturerGarmin, typedef.GarminProductFr965.Uint16(), 2026},
+	{"edge540", "Garmin Edge 540", typedef.ManufacturerGarmin, typedef.GarminProductEdge540.Uint16(), 2622},
+	{"edge840", "Garmin Edge 840", typedef.ManufacturerGarmin, typedef.GarminProductEdge840.Uint16(), 2622},
+	{"edge1040", "Garmin Edge 1040", typedef.ManufacturerGarmin, typedef.GarminProductEdge1040.Uint16(), 2622},
+	{"edge1050", "Garmin Edge 1050", typedef.ManufacturerGarmin, typedef.GarminProductEdge1050.Uint16(), 1418},
+}
+
+// lookupSpoofProfile returns the catalogue profile with the given ID.
+func lookupSpoofProfile(id string) (spoofProfile, bool) {
+	for _, p := range spoofProfiles {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return spoofProfile{}, false
+}
+
+// spoofProfileIDs lists the selectable profile IDs, custom included.
+func spoofProfileIDs() []string {
+	ids := make([]string, 0, len(spoofProfiles)+1)
+	for _, p := range spoofProfiles {
+		ids = append(ids, p.ID)
+	}
+	return append(ids, customProfileID)
+}
+
+// profile resolves the configured spoof profile.
+func (c deviceConfig) profile() (spoofProfile, error) {
+	switch c.Profile {
+	case "":
+		p, _ := lookupSpoofProfile(defaultProfileID)
+		return p, nil
+	case customProfileID:
+		if c.ProductID == 0 || c.ProductID == uint16Invalid {
+			return spoofProfile{}, fmt.Errorf("custom device profile needs a product ID")
+		}
+		name := c.ProductName
+		if name == "" {
+			name = fmt.Sprintf("Garmin product %d", c.ProductID)
+		}
+		return spoofProfile{
+			ID:           customProfileID,
+			Name:         name,
+			Manufacturer: typedef.ManufacturerGarmin,
+			Product:      c.ProductID,
+		}, nil
+	}
+	p, ok := lookupSpoofProfile(c.Profile)
+	if !ok {
+		return spoofProfile{}, fmt.Errorf("unknown device profile %q (choose from %s)",
+			c.Profile, strings.Join(spoofProfileIDs(), ", "))
+	}
+	return p, nil
+}
+
+// newSerialNumber returns a random 10-digit serial number, in the range
+// real Garmin devices use.
+func newSerialNumber() uint32 {
+	return 3_000_000_000 + rand.Uint32N(1_000_000_000)
+}
+
+// Actions for sensor (non-creator) device_info entries.
+const (
+	sensorKeep  = "keep"  // leave the entry as recorded
+	sensorMap   = "map"   // set the rule's manufacturer/product, keep the serial
+	sensorSpoof = "spoof" // rewrite like the creator device
+)
+
+// sensorRule says what to do with one type of sensor.
+type sensorRule struct {
+	Action       string `json:"action"`
+	Manufacturer uint16 `json:"manufacturer,omitempty"` // for "map"
+	Product      uint16 `json:"product,omitempty"`      // for "map"
+}
+
+// anySensor keys the rule for sensor types without a rule of their own.
+const anySensor = "*"
+
+// parseSensorRule parses TYPE=ACTION[:MANUFACTURER:PRODUCT], e.g.
+// "heart_rate=keep" or "fitness_equipment=map:garmin:3121".
+func parseSensorRule(s string) (string, sensorRule, error) {
+	typ, spec, ok := strings.Cut(s, "=")
+	if !ok || typ == "" {
+		return "", sensorRule{}, fmt.Errorf("want TYPE=ACTION, got %q", s)
+	}
+	parts := strings.Split(spec, ":")
+	rule := sensorRule{Action: parts[0]}
+	switch {
+	case rule.Action == sensorMap && len(parts) == 3:
+		m := typedef.ManufacturerFromString(parts[1])
+		if m == typedef.ManufacturerInvalid {
+			n, err := strconv.ParseUint(parts[1], 10, 16)
+			if err != nil {
+				return "", sensorRule{}, fmt.Errorf("unknown manufacturer %q", parts[1])
+			}
+			m = typedef.Manufacturer(n)
+		}
+		p, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil {
+			return "", sensorRule{}, fmt.Errorf("bad product %q", parts[2])
+		}
+		rule.Manufacturer, rule.Product = uint16(m), uint16(p)
+	case rule.Action == sensorMap:
+		return "", sensorRule{}, fmt.Errorf("map needs MANUFACTURER:PRODUCT, got %q", spec)
+	case (rule.Action == sensorKeep || rule.Action == sensorSpoof) && len(parts) == 1:
+	default:
+		return "", sensorRule{}, fmt.Errorf("unknown sensor action %q (keep, map or spoof)", spec)
+	}
+	return typ, rule, nil
+}
+
+// sensorRule returns the rule for a sensor type, falling back to the "*"
+// rule and then to keeping the entry.
+func (c deviceConfig) sensorRule(typ string) sensorRule {
+	if r, ok := c.Sensors[typ]; ok {
+		return r
+	}
+	if r, ok := c.Sensors[anySensor]; ok {
+		return r
+	}
+	return sensorRule{Action: sensorKeep}
+}
+
+// sensorType names the kind of sensor a device_info entry describes, e.g.
+// "heart_rate" or "bike_power". The name depends on how it was connected.
+func sensorType(di *mesgdef.DeviceInfo) string {
+	var name string
+	switch di.SourceType {
+	case typedef.SourceTypeAnt, typedef.SourceTypeAntplus:
+		name = typedef.AntplusDeviceType(di.DeviceType).String()
+	case typedef.SourceTypeBluetooth, typedef.SourceTypeBluetoothLowEnergy:
+		name = typedef.BleDeviceType(di.DeviceType).String()
+	case typedef.SourceTypeLocal:
+		name = typedef.LocalDeviceType(di.DeviceType).String()
+	}
+	if name == "" || strings.Contains(name, "Invalid") {
+		return "unknown"
+	}
+	return name
+}
+
+// isCreator reports whether di describes the device that created the file:
+// device index 0, or an entry without index that matches file_id.
+func isCreator(di *mesgdef.DeviceInfo, fileID *mesgdef.FileId) bool {
+	if di.DeviceIndex == typedef.DeviceIndexCreator {
+		return true
+	}
+	return di.DeviceIndex == typedef.DeviceIndexInvalid &&
+		di.Manufacturer == fileID.Manufacturer && di.Product == fileID.Product
+}
+
+// creatorDevices returns the device_info entries of the file's creator.
+// When none is marked as such, the first entry that isn't a recognised
+// sensor is taken for it, so the MyWhoosh identity doesn't stay behind.
+func creatorDevices(activity *filedef.Activity) []*mesgdef.DeviceInfo {
+	var creators []*mesgdef.DeviceInfo
+	for _, di := range activity.DeviceInfos {
+		if isCreator(di, &activity.FileId) {
+			creators = append(creators, di)
+		}
+	}
+	if len(creators) > 0 {
+		return creators
+	}
+	for _, di := range activity.DeviceInfos {
+		if sensorType(di) == "unknown" {
+			return []*mesgdef.DeviceInfo{di}
+		}
+	}
+	return nil
+}
+
+// deviceFixer rewrites the device identity so Garmin computes training
+// effect, VO2max and load for the activity.
+type deviceFixer struct {
+	cfg deviceConfig
+}
+
+func (f *deviceFixer) Name() string { return "spoof-device" }
+
+func (f *deviceFixer) Fix(activity *filedef.Activity) ([]string, error) {
+	profile, err := f.cfg.profile()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sensors are classified against the original creator, before file_id
+	// is rewritten.
+	var sensorChanges []string
+	creators := creatorDevices(activity)
+	isCreatorDevice := make(map[*mesgdef.DeviceInfo]bool, len(creators))
+	for _, di := range creators {
+		isCreatorDevice[di] = true
+	}
+	for _, di := range activity.DeviceInfos {
+		if isCreatorDevice[di] {
+			continue
+		}
+		typ := sensorType(di)
+		switch rule := f.cfg.sensorRule(typ); rule.Action {
+		case sensorSpoof:
+			creators = append(creators, di)
+			sensorChanges = append(sensorChanges, fmt.Sprintf("sensor %s spoofed", typ))
+		case sensorMap:
+			di.Manufacturer = typedef.Manufacturer(rule.Manufacturer)
+			di.Product = rule.Product
+			sensorChanges = append(sensorChanges, fmt.Sprintf("sensor %s mapped to %s product %d",
+				typ, di.Manufacturer, di.Product))
+		}
+	}
+
+	spoofDevice(activity, creators, profile, f.cfg.SerialNumber)
+	changes := []string{fmt.Sprintf("device spoofed: %s (product %d, serial %d)",
+		profile.Name, profile.Product, activity.FileId.SerialNumber)}
+	return append(changes, sensorChanges...), nil
+}
+
+// spoofDevice writes the profile's identity into file_id and the given
+// device_info entries. A zero serial keeps the serial numbers the file
+// already has.
+func spoofDevice(activity *filedef.Activity, devices []*mesgdef.DeviceInfo, profile spoofProfile, serial uint32) {
+	activity.FileId.Manufacturer = profile.Manufacturer
+	activity.FileId.Product = profile.Product
+	if serial != 0 {
+		activity.FileId.SerialNumber = serial
+	}
+
+	for _, di := range devices {
+		di.Manufacturer = profile.Manufacturer
+		di.Product = profile.Product
+		if serial != 0 {
+			di.SerialNumber = serial
+		}
+		di.ProductName = profile.Name
+		if profile.SoftwareVersion != 0 {
+			di.SoftwareVersion = profile.SoftwareVersion
+		}
+	}
+}
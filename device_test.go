@@ -0,0 +1,172 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+)
+
+func TestDeviceConfigProfile(t *testing.T) {
+	p, err := deviceConfig{Profile: "edge840"}.profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Product != typedef.GarminProductEdge840.Uint16() {
+		t.Errorf("edge840: got product %d", p.Product)
+	}
+
+	p, err = deviceConfig{Profile: customProfileID, ProductID: 4315}.profile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Product != 4315 || p.Manufacturer != typedef.ManufacturerGarmin {
+		t.Errorf("custom: got %+v", p)
+	}
+
+	if _, err := (deviceConfig{Profile: customProfileID}).profile(); err == nil {
+		t.Error("custom without product ID: expected error")
+	}
+	if _, err := (deviceConfig{Profile: "nokia3310"}).profile(); err == nil {
+		t.Error("unknown profile: expected error")
+	}
+}
+
+func TestDeviceFixerProfile(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.FileId.SetManufacturer(typedef.ManufacturerDevelopment)
+	activity.DeviceInfos = append(activity.DeviceInfos,
+		mesgdef.NewDeviceInfo(nil).SetDeviceIndex(typedef.DeviceIndexCreator))
+
+	f := &deviceFixer{cfg: deviceConfig{Enabled: true, Profile: "fr965", SerialNumber: 3512345678}}
+	if _, err := f.Fix(activity); err != nil {
+		t.Fatal(err)
+	}
+
+	want := typedef.GarminProductFr965.Uint16()
+	if activity.FileId.Manufacturer != typedef.ManufacturerGarmin || activity.FileId.Product != want {
+		t.Errorf("file_id: got %s/%d, want garmin/%d",
+			activity.FileId.Manufacturer, activity.FileId.Product, want)
+	}
+	if activity.FileId.SerialNumber != 3512345678 {
+		t.Errorf("file_id serial: got %d", activity.FileId.SerialNumber)
+	}
+	di := activity.DeviceInfos[0]
+	if di.Product != want || di.ProductName != "Garmin Forerunner 965" {
+		t.Errorf("device_info: got product %d %q", di.Product, di.ProductName)
+	}
+	if di.SerialNumber != 3512345678 {
+		t.Errorf("device_info serial: got %d", di.SerialNumber)
+	}
+}
+
+func TestSpoofDeviceKeepsSerialWhenUnset(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.FileId.SetSerialNumber(1234)
+
+	p, _ := lookupSpoofProfile(defaultProfileID)
+	spoofDevice(activity, nil, p, 0)
+	if activity.FileId.SerialNumber != 1234 {
+		t.Errorf("serial: got %d, want 1234 kept", activity.FileId.SerialNumber)
+	}
+}
+
+func TestNewSerialNumber(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		n := newSerialNumber()
+		if n < 1_000_000_000 {
+			t.Fatalf("serial %d has fewer than 10 digits", n)
+		}
+	}
+}
+
+func TestDeviceFixerKeepsSensors(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.FileId.SetManufacturer(typedef.ManufacturerDevelopment).SetProduct(7)
+	creator := mesgdef.NewDeviceInfo(nil).
+		SetDeviceIndex(typedef.DeviceIndexCreator).
+		SetManufacturer(typedef.ManufacturerDevelopment).
+		SetProduct(7)
+	hrm := mesgdef.NewDeviceInfo(nil).
+		SetDeviceIndex(1).
+		SetSourceType(typedef.SourceTypeAntplus).
+		SetDeviceType(uint8(typedef.AntplusDeviceTypeHeartRate)).
+		SetManufacturer(typedef.ManufacturerWahooFitness).
+		SetProduct(12).
+		SetSerialNumber(5555)
+	trainer := mesgdef.NewDeviceInfo(nil).
+		SetDeviceIndex(2).
+		SetSourceType(typedef.SourceTypeBluetoothLowEnergy).
+		SetDeviceType(uint8(typedef.BleDeviceTypeBikeTrainer)).
+		SetManufacturer(typedef.ManufacturerTacx).
+		SetProduct(40).
+		SetSerialNumber(6666)
+	activity.DeviceInfos = append(activity.DeviceInfos, creator, hrm, trainer)
+
+	cfg := deviceConfig{
+		Enabled:      true,
+		Profile:      "edge840",
+		SerialNumber: 3512345678,
+		Sensors: map[string]sensorRule{
+			"bike_trainer": {Action: sensorMap, Manufacturer: uint16(typedef.ManufacturerGarmin), Product: 3121},
+		},
+	}
+	if _, err := (&deviceFixer{cfg: cfg}).Fix(activity); err != nil {
+		t.Fatal(err)
+	}
+
+	if creator.Product != typedef.GarminProductEdge840.Uint16() || creator.SerialNumber != 3512345678 {
+		t.Errorf("creator not spoofed: product %d serial %d", creator.Product, creator.SerialNumber)
+	}
+	if hrm.Manufacturer != typedef.ManufacturerWahooFitness || hrm.Product != 12 || hrm.SerialNumber != 5555 {
+		t.Errorf("heart rate strap changed: %s/%d/%d", hrm.Manufacturer, hrm.Product, hrm.SerialNumber)
+	}
+	if trainer.Manufacturer != typedef.ManufacturerGarmin || trainer.Product != 3121 || trainer.SerialNumber != 6666 {
+		t.Errorf("trainer not mapped: %s/%d/%d", trainer.Manufacturer, trainer.Product, trainer.SerialNumber)
+	}
+}
+
+func TestDeviceFixerCreatorWithoutIndex(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.FileId.SetManufacturer(typedef.ManufacturerDevelopment).SetProduct(7)
+	// Neither entry has index 0, and the app's own doesn't match file_id.
+	app := mesgdef.NewDeviceInfo(nil).
+		SetManufacturer(typedef.ManufacturerDevelopment).
+		SetProduct(8)
+	hrm := mesgdef.NewDeviceInfo(nil).
+		SetDeviceIndex(1).
+		SetSourceType(typedef.SourceTypeAntplus).
+		SetDeviceType(uint8(typedef.AntplusDeviceTypeHeartRate)).
+		SetManufacturer(typedef.ManufacturerWahooFitness).
+		SetProduct(12)
+	activity.DeviceInfos = append(activity.DeviceInfos, hrm, app)
+
+	cfg := deviceConfig{Enabled: true, Profile: "edge840", SerialNumber: 3512345678}
+	if _, err := (&deviceFixer{cfg: cfg}).Fix(activity); err != nil {
+		t.Fatal(err)
+	}
+	if app.Manufacturer != typedef.ManufacturerGarmin || app.Product != typedef.GarminProductEdge840.Uint16() {
+		t.Errorf("app entry not spoofed: %s/%d", app.Manufacturer, app.Product)
+	}
+	if hrm.Manufacturer != typedef.ManufacturerWahooFitness || hrm.Product != 12 {
+		t.Errorf("heart rate strap changed: %s/%d", hrm.Manufacturer, hrm.Product)
+	}
+}
+
+func TestParseSensorRule(t *testing.T) {
+	typ, rule, err := parseSensorRule("fitness_equipment=map:garmin:3121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != "fitness_equipment" || rule.Action != sensorMap ||
+		rule.Manufacturer != uint16(typedef.ManufacturerGarmin) || rule.Product != 3121 {
+		t.Errorf("got %s %+v", typ, rule)
+	}
+
+	for _, bad := range []string{"heart_rate", "heart_rate=drop", "bike_power=map", "bike_power=keep:1:2"} {
+		if _, _, err := parseSensorRule(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -22,16 +27,10 @@ import (
 const (
 	uint8Invalid  = uint8(0xFF)
 	uint16Invalid = uint16(0xFFFF)
+	uint32Invalid = uint32(0xFFFFFFFF)
 	sint8Invalid  = int8(0x7F)
 )
 
-// Device spoofing constants.
-const (
-	garminManufacturer = typedef.ManufacturerGarmin   // 1
-	fenix6sProduct     = typedef.GarminProductFenix6s // 3288
-	fakeSerialNumber   = uint32(3420897194)
-)
-
 // logFn can be overridden to redirect log output (e.g., to a GUI).
 var logFn = func(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
@@ -41,10 +40,13 @@ var logFn = func(format string, args ...interface{}) {
 // MyWhoosh directory detection
 // ---------------------------------------------------------------------------
 
-func findMyWhooshDir() (string, error) {
+// findMyWhooshDirs returns every MyWhoosh data directory found on this
+// machine: one per Windows user package, or per Wine prefix on Linux. It
+// returns an error when there is none.
+func findMyWhooshDirs() ([]string, error) {
 	home, err := os.UserHomeDir()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	switch runtime.GOOS {
@@ -54,30 +56,136 @@ func findMyWhooshDir() (string, error) {
 			"Data", "Library", "Application Support",
 			"Epic", "MyWhoosh", "Content", "Data")
 		if isDir(p) {
-			return p, nil
+			return []string{p}, nil
 		}
-		return "", fmt.Errorf("not found: %s", p)
+		return nil, fmt.Errorf("not found: %s", p)
 
 	case "windows":
 		base := filepath.Join(home, "AppData", "Local", "Packages")
-		entries, err := os.ReadDir(base)
-		if err != nil {
-			return "", err
+		if dirs := packagesDataDirs(base); len(dirs) > 0 {
+			return dirs, nil
+		}
+		return nil, fmt.Errorf("MyWhoosh not found in %s", base)
+
+	case "linux":
+		if dirs := wineDataDirs(home); len(dirs) > 0 {
+			return dirs, nil
+		}
+		return nil, fmt.Errorf("MyWhoosh not found in any Wine, Proton, Lutris or Bottles prefix")
+
+	default:
+		return nil, fmt.Errorf("no auto-detection for %s — use the directory picker", runtime.GOOS)
+	}
+}
+
+// packagesDataDirs returns the MyWhoosh data directories in a Windows
+// AppData\Local\Packages directory.
+func packagesDataDirs(base string) []string {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "MyWhooshTechnologyService.") {
+			p := filepath.Join(base, e.Name(),
+				"LocalCache", "Local", "MyWhoosh", "Content", "Data")
+			if isDir(p) {
+				dirs = append(dirs, p)
+			}
 		}
-		for _, e := range entries {
-			if e.IsDir() && strings.HasPrefix(e.Name(), "MyWhooshTechnologyService.") {
-				p := filepath.Join(base, e.Name(),
-					"LocalCache", "Local", "MyWhoosh", "Content", "Data")
-				if isDir(p) {
-					return p, nil
+	}
+	return dirs
+}
+
+// winePrefixPatterns are the glob patterns, relative to the home directory,
+// of the Wine prefixes MyWhoosh may be installed in on Linux.
+var winePrefixPatterns = []string{
+	// Plain Wine
+	".wine",
+	// Steam Proton, native and flatpak
+	".steam/steam/steamapps/compatdata/*/pfx",
+	".local/share/Steam/steamapps/compatdata/*/pfx",
+	".var/app/com.valvesoftware.Steam/.local/share/Steam/steamapps/compatdata/*/pfx",
+	// Lutris
+	"Games/*",
+	".local/share/lutris/prefixes/*",
+	// Bottles, native and flatpak
+	".local/share/bottles/bottles/*",
+	".var/app/com.usebottles.bottles/data/bottles/bottles/*",
+}
+
+// wineDataDirs returns the MyWhoosh data directories in the Wine prefixes
+// under home. Prefixes reached through symlinks are reported once.
+func wineDataDirs(home string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, pattern := range winePrefixPatterns {
+		prefixes, _ := filepath.Glob(filepath.Join(home, filepath.FromSlash(pattern)))
+		for _, prefix := range prefixes {
+			packages, _ := filepath.Glob(filepath.Join(prefix,
+				"drive_c", "users", "*", "AppData", "Local", "Packages"))
+			for _, base := range packages {
+				for _, dir := range packagesDataDirs(base) {
+					real, err := filepath.EvalSymlinks(dir)
+					if err != nil {
+						real = dir
+					}
+					if !seen[real] {
+						seen[real] = true
+						dirs = append(dirs, dir)
+					}
 				}
 			}
 		}
-		return "", fmt.Errorf("MyWhoosh not found in %s", base)
+	}
+	return dirs
+}
 
-	default:
-		return "", fmt.Errorf("no auto-detection for %s — use the directory picker", runtime.GOOS)
+// dirCandidate is a MyWhoosh data directory found on this machine.
+type dirCandidate struct {
+	Path     string
+	FitFiles int       // number of *.fit files
+	Newest   time.Time // start of the newest activity; zero without any
+}
+
+func (c dirCandidate) String() string {
+	newest := "no activities"
+	if !c.Newest.IsZero() {
+		newest = "newest " + c.Newest.Local().Format("2006-01-02")
 	}
+	return fmt.Sprintf("%s (%d FIT files, %s)", c.Path, c.FitFiles, newest)
+}
+
+// findDirCandidates returns the MyWhoosh data directories found on this
+// machine with what they hold, the one with the newest activity first.
+func findDirCandidates() ([]dirCandidate, error) {
+	dirs, err := findMyWhooshDirs()
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]dirCandidate, len(dirs))
+	for i, dir := range dirs {
+		candidates[i] = describeDir(dir)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Newest.After(candidates[j].Newest)
+	})
+	return candidates, nil
+}
+
+// describeDir counts the FIT files in dir and finds the newest activity.
+func describeDir(dir string) dirCandidate {
+	c := dirCandidate{Path: dir}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.fit"))
+	c.FitFiles = len(matches)
+	for _, path := range matches {
+		f, err := readActivityFile(path)
+		if err == nil && f.Meta.Start.After(c.Newest) {
+			c.Newest = f.Meta.Start
+		}
+	}
+	return c
 }
 
 func isDir(path string) bool {
@@ -133,80 +241,58 @@ func generateOutputFilename(inputPath string) string {
 
 // fixFitFile reads a MyWhoosh FIT activity, fixes missing session averages,
 // strips temperature from records, spoofs the device, and writes the result.
+// It runs the default pipeline; see fixPipeline for a configurable one.
 func fixFitFile(inputPath, outputPath string) error {
-	f, err := os.Open(inputPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	_, err := newFixPipeline(defaultFixConfig()).FixFile(inputPath, outputPath)
+	return err
+}
 
+// decodeActivity decodes a FIT activity file from r.
+func decodeActivity(r io.Reader) (*filedef.Activity, error) {
 	lis := filedef.NewListener()
 	defer lis.Close()
 
-	dec := decoder.New(f,
+	dec := decoder.New(r,
 		decoder.WithMesgListener(lis),
 		decoder.WithBroadcastOnly(),
 	)
 
-	_, err = dec.Decode()
+	_, err := dec.Decode()
 	if err != nil {
-		return fmt.Errorf("decode: %w", err)
+		return nil, fmt.Errorf("decode: %w", err)
 	}
 
 	activity, ok := lis.File().(*filedef.Activity)
 	if !ok {
-		return fmt.Errorf("not an activity file (got %T)", lis.File())
+		return nil, fmt.Errorf("not an activity file (got %T)", lis.File())
 	}
+	return activity, nil
+}
 
-	// Collect metrics from records and strip temperature
-	var powers []uint16
-	var heartRates, cadences []uint8
+// encodeActivity encodes the activity to w as a FIT (protocol V2) file.
+func encodeActivity(w io.Writer, activity *filedef.Activity) error {
+	fit := activity.ToFIT(nil)
+	return encoder.New(w, encoder.WithProtocolVersion(proto.V2)).Encode(&fit)
+}
 
-	for _, rec := range activity.Records {
-		if rec.Power != uint16Invalid {
-			powers = append(powers, rec.Power)
-		}
-		if rec.HeartRate != uint8Invalid {
-			heartRates = append(heartRates, rec.HeartRate)
-		}
-		if rec.Cadence != uint8Invalid {
-			cadences = append(cadences, rec.Cadence)
-		}
-		rec.Temperature = sint8Invalid
-	}
+// temperatureFixer strips the fake temperature MyWhoosh writes into every
+// record.
+type temperatureFixer struct{}
 
-	logFn("Records: %d | Power: %d | HR: %d | Cadence: %d samples\n",
-		len(activity.Records), len(powers), len(heartRates), len(cadences))
+func (f *temperatureFixer) Name() string { return "strip-temperature" }
 
-	// Fix missing session averages
-	for _, sess := range activity.Sessions {
-		if shouldFixU16(sess.AvgPower) && len(powers) > 0 {
-			sess.AvgPower = avgU16(powers)
-			logFn("  → avg power:      %d W\n", sess.AvgPower)
-		}
-		if shouldFixU8(sess.AvgHeartRate) && len(heartRates) > 0 {
-			sess.AvgHeartRate = avgU8(heartRates)
-			logFn("  → avg heart rate: %d bpm\n", sess.AvgHeartRate)
-		}
-		if shouldFixU8(sess.AvgCadence) && len(cadences) > 0 {
-			sess.AvgCadence = avgU8(cadences)
-			logFn("  → avg cadence:    %d rpm\n", sess.AvgCadence)
+func (f *temperatureFixer) Fix(activity *filedef.Activity) ([]string, error) {
+	stripped := 0
+	for _, rec := range activity.Records {
+		if rec.Temperature != sint8Invalid {
+			rec.Temperature = sint8Invalid
+			stripped++
 		}
 	}
-
-	// Spoof device
-	spoofDevice(activity)
-
-	// Encode
-	fit := activity.ToFIT(nil)
-
-	out, err := os.Create(outputPath)
-	if err != nil {
-		return err
+	if stripped == 0 {
+		return nil, nil
 	}
-	defer out.Close()
-
-	return encoder.New(out, encoder.WithProtocolVersion(proto.V2)).Encode(&fit)
+	return []string{fmt.Sprintf("temperature stripped from %d records", stripped)}, nil
 }
 
 func shouldFixU16(v uint16) bool { return v == uint16Invalid || v == 0 }
@@ -229,69 +315,220 @@ func avgU8(vals []uint8) uint8 {
 }
 
 // ---------------------------------------------------------------------------
-// Device spoofing
+// Sync helpers
 // ---------------------------------------------------------------------------
 
-func spoofDevice(activity *filedef.Activity) {
-	activity.FileId.Manufacturer = garminManufacturer
-	activity.FileId.Product = fenix6sProduct.Uint16()
-	activity.FileId.SerialNumber = fakeSerialNumber
+// activityKey identifies one recorded ride independently of its file name.
+// MyWhoosh saves later rides under a name it used before, so the content
+// hash and start time tell rides apart.
+type activityKey struct {
+	SHA256 string    `json:"sha256"`
+	Start  time.Time `json:"start"` // zero when the file can't be decoded
+}
 
-	for _, di := range activity.DeviceInfos {
-		di.Manufacturer = garminManufacturer
-		di.Product = fenix6sProduct.Uint16()
-		di.SerialNumber = fakeSerialNumber
-	}
+// activityMeta describes an activity for display. It is read once, when
+// the file is discovered.
+type activityMeta struct {
+	Start    time.Time     // zero when the file can't be decoded
+	Duration time.Duration // timer time, without pauses
+	Sport    string        // e.g. "cycling"
+}
 
-	logFn("  → device spoofed: Garmin Fenix 6S Pro (product %d)\n", fenix6sProduct)
+func (m activityMeta) String() string {
+	if m.Start.IsZero() {
+		return "unknown activity"
+	}
+	parts := []string{m.Start.Local().Format("2006-01-02 15:04")}
+	if m.Sport != "" {
+		parts = append(parts, m.Sport)
+	}
+	if m.Duration > 0 {
+		d := m.Duration.Round(time.Minute)
+		parts = append(parts, fmt.Sprintf("%d:%02d h", int(d.Hours()), int(d.Minutes())%60))
+	}
+	return strings.Join(parts, " · ")
 }
 
-// ---------------------------------------------------------------------------
-// Sync helpers
-// ---------------------------------------------------------------------------
+// activityFile is a FIT file found in the MyWhoosh directory or archive.
+type activityFile struct {
+	Path string
+	Key  activityKey
+	Meta activityMeta
+}
 
-// findUnsyncedFitFiles returns *.fit files modified in the last 30 days
-// that don't have a .synced marker file next to them.
-func findUnsyncedFitFiles(dir string) ([]string, error) {
-	matches, err := filepath.Glob(filepath.Join(dir, "*.fit"))
+// readActivityFile hashes the file at path and reads its activity metadata.
+// A file that can't be decoded still gets a key, without a start time.
+func readActivityFile(path string) (activityFile, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return activityFile{}, err
 	}
+	return parseActivityFile(path, data, hashBytes(data)), nil
+}
 
-	cutoff := time.Now().AddDate(0, 0, -30)
-	var result []string
+// parseActivityFile decodes data, the content of the file at path with
+// hash sha. An undecodable file has no metadata and a zero start time.
+func parseActivityFile(path string, data []byte, sha string) activityFile {
+	f := activityFile{Path: path, Key: activityKey{SHA256: sha}}
+	if activity, err := decodeActivity(bytes.NewReader(data)); err == nil {
+		f.Meta = activityInfo(activity)
+		f.Key.Start = f.Meta.Start
+	}
+	return f
+}
 
-	for _, path := range matches {
-		info, err := os.Stat(path)
-		if err != nil {
-			continue
+// readActivityKey hashes the file at path and reads the activity start time.
+func readActivityKey(path string) (activityKey, error) {
+	f, err := readActivityFile(path)
+	return f.Key, err
+}
+
+// activityInfo reads the metadata of a decoded activity.
+func activityInfo(activity *filedef.Activity) activityMeta {
+	m := activityMeta{Start: activityStart(activity)}
+	if len(activity.Sessions) > 0 {
+		sess := activity.Sessions[0]
+		if sess.TotalTimerTime != uint32Invalid {
+			m.Duration = time.Duration(sess.TotalTimerTime) * time.Millisecond
 		}
-		if info.ModTime().Before(cutoff) {
-			continue
+		if sess.Sport != typedef.SportInvalid {
+			m.Sport = sess.Sport.String()
 		}
-		if isSynced(path) {
-			continue
+	}
+	if m.Duration == 0 && len(activity.Records) > 1 {
+		m.Duration = activity.Records[len(activity.Records)-1].Timestamp.Sub(activity.Records[0].Timestamp)
+	}
+	return m
+}
+
+// stableWindow is how long a file must go unmodified before it is read:
+// MyWhoosh writes the activity at the end of a ride.
+const stableWindow = 5 * time.Second
+
+// brokenAfter is how long an unreadable file is waited for before it is
+// considered broken rather than still being written.
+const brokenAfter = time.Hour
+
+// errNotReady marks a FIT file that MyWhoosh is still writing.
+var errNotReady = errors.New("still being written")
+
+// checkReady makes sure the FIT file is complete before it enters the
+// pipeline: unmodified for stableWindow, decodable with a valid CRC, and
+// holding an activity message. It returns the file's key, or an error
+// wrapping errNotReady while the file may still be written. Files that
+// stay unreadable past brokenAfter get a plain error.
+func checkReady(path string, now time.Time) (activityKey, error) {
+	before, err := os.Stat(path)
+	if err != nil {
+		return activityKey{}, err
+	}
+	age := now.Sub(before.ModTime())
+	if age < stableWindow {
+		return activityKey{}, fmt.Errorf("%w: modified %s ago", errNotReady, age.Round(time.Second))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return activityKey{}, err
+	}
+	activity, err := decodeActivity(bytes.NewReader(data))
+	if err == nil && activity.Activity == nil {
+		err = errors.New("no activity message")
+	}
+	if err != nil {
+		if age < brokenAfter {
+			return activityKey{}, fmt.Errorf("%w: %v", errNotReady, err)
 		}
-		result = append(result, path)
+		return activityKey{}, fmt.Errorf("not a complete FIT activity: %w", err)
 	}
 
-	// Sort oldest first so we upload in chronological order
-	sort.Slice(result, func(i, j int) bool {
-		ii, _ := os.Stat(result[i])
-		jj, _ := os.Stat(result[j])
-		return ii.ModTime().Before(jj.ModTime())
-	})
+	after, err := os.Stat(path)
+	if err != nil {
+		return activityKey{}, err
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return activityKey{}, fmt.Errorf("%w: changed while reading", errNotReady)
+	}
 
-	return result, nil
+	return activityKey{SHA256: hashBytes(data), Start: activityStart(activity)}, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return hashBytes(data), nil
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
-// isSynced checks if a .synced marker file exists for the given FIT file.
-func isSynced(fitPath string) bool {
-	_, err := os.Stat(fitPath + ".synced")
-	return err == nil
+// activityStart returns when the activity started: the first session's
+// start time, else the file creation time, else the first record.
+func activityStart(activity *filedef.Activity) time.Time {
+	if len(activity.Sessions) > 0 && !activity.Sessions[0].StartTime.IsZero() {
+		return activity.Sessions[0].StartTime
+	}
+	if !activity.FileId.TimeCreated.IsZero() {
+		return activity.FileId.TimeCreated
+	}
+	if len(activity.Records) > 0 {
+		return activity.Records[0].Timestamp
+	}
+	return time.Time{}
 }
 
-// markSynced creates a .synced marker file next to the FIT file.
-func markSynced(fitPath string) error {
-	return os.WriteFile(fitPath+".synced", []byte(time.Now().Format(time.RFC3339)), 0o644)
+// findUnsyncedFitFiles returns the FIT files under dir (the archive, or a
+// MyWhoosh directory) whose activity started in rng and isn't in the ledger
+// yet. Files without a start time are matched by modification time. Fixed
+// versions in the archive are skipped, and so are archive months outside
+// rng. Files already in the ledger are recognised by their hash, so only
+// new ones are decoded.
+func findUnsyncedFitFiles(dir string, ledger *syncLedger, rng dateRange) ([]activityFile, error) {
+	type candidate struct {
+		file activityFile
+		at   time.Time // start time, or modification time
+	}
+	var found []candidate
+
+	err := walkFitFiles(dir, rng, func(path string, info os.FileInfo) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		sha := hashBytes(data)
+		if ledger.HasContent(sha) {
+			return
+		}
+		f := parseActivityFile(path, data, sha)
+		at := f.Meta.Start
+		if at.IsZero() {
+			at = info.ModTime()
+		}
+		if !rng.Contains(at) {
+			return
+		}
+		found = append(found, candidate{file: f, at: at})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Upload oldest first: Garmin's training load depends on the order
+	sort.SliceStable(found, func(i, j int) bool {
+		if !found[i].at.Equal(found[j].at) {
+			return found[i].at.Before(found[j].at)
+		}
+		return found[i].file.Path < found[j].file.Path
+	})
+
+	result := make([]activityFile, len(found))
+	for i, c := range found {
+		result[i] = c.file
+	}
+	return result, nil
 }
@@ -2,37 +2,57 @@ package garmin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 const apiUserAgent = "GCM-iOS-5.19.1.2"
 
 // Client manages authentication and uploads to Garmin Connect.
+// Requests have no timeout of their own: each call takes a context, and
+// cancelling it aborts the requests in flight.
 type Client struct {
 	OAuth1   *OAuth1Token
 	OAuth2   *OAuth2Token
 	Domain   string
 	TokenDir string // directory where tokens are cached
+
+	// PromptMFA is asked for the one-time code when the account has
+	// two-factor authentication. Login fails on an MFA challenge without it.
+	PromptMFA MFAPrompt
+
+	// Set by options; empty means the default.
+	httpClient  *http.Client
+	ssoURL      string
+	apiURL      string
+	consumerURL string
+	userAgent   string
 }
 
 // NewClient creates a Client that caches tokens in tokenDir.
-func NewClient(tokenDir string) *Client {
-	return &Client{
+func NewClient(tokenDir string, opts ...Option) *Client {
+	c := &Client{
 		Domain:   "garmin.com",
 		TokenDir: tokenDir,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 // Resume tries to load cached tokens and refresh if needed.
 // Returns nil if a valid session was restored, error otherwise.
-func (c *Client) Resume() error {
+func (c *Client) Resume(ctx context.Context) error {
 	if c.TokenDir == "" {
 		return fmt.Errorf("no token directory configured")
 	}
@@ -55,15 +75,15 @@ func (c *Client) Resume() error {
 
 	// OAuth2 expired — try to refresh using OAuth1 (lasts ~1 year)
 	fmt.Println("  session expired, refreshing...")
-	if err := c.refreshOAuth2(); err != nil {
+	if err := c.refreshOAuth2(ctx); err != nil {
 		return fmt.Errorf("refresh failed: %w", err)
 	}
 	return nil
 }
 
 // Login performs a fresh SSO login with the given credentials.
-func (c *Client) Login(email, password string) error {
-	oauth1, oauth2, err := Login(email, password, c.Domain)
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	oauth1, oauth2, err := c.login(ctx, email, password)
 	if err != nil {
 		return err
 	}
@@ -80,44 +100,123 @@ func (c *Client) Login(email, password string) error {
 	return nil
 }
 
-// UploadFIT uploads a FIT file to Garmin Connect.
+// UploadFIT uploads a FIT file to Garmin Connect and returns what Garmin
+// made of it. When Garmin processes the file asynchronously, UploadFIT
+// polls the upload status until the activity ID is known. Once Garmin has
+// accepted the file only a rejection is an error: if the status can't be
+// had, the result just has no activity IDs.
 // Automatically refreshes the OAuth2 token if expired.
-func (c *Client) UploadFIT(filePath string) error {
+func (c *Client) UploadFIT(ctx context.Context, filePath string) (*UploadResult, error) {
 	if c.OAuth2 == nil {
-		return fmt.Errorf("not authenticated")
+		return nil, fmt.Errorf("not authenticated")
 	}
 
 	// Auto-refresh if expired
 	if c.OAuth2.Expired() {
-		if err := c.refreshOAuth2(); err != nil {
-			return fmt.Errorf("token refresh: %w", err)
+		if err := c.refreshOAuth2(ctx); err != nil {
+			return nil, fmt.Errorf("token refresh: %w", err)
 		}
 	}
 
 	// First attempt
-	status, body, err := c.doUpload(filePath)
+	status, body, err := c.doUpload(ctx, filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Retry once on 401 (token might be stale despite not being expired)
 	if status == 401 {
 		fmt.Println("  token rejected, refreshing...")
-		if err := c.refreshOAuth2(); err != nil {
-			return fmt.Errorf("token refresh: %w", err)
+		if err := c.refreshOAuth2(ctx); err != nil {
+			return nil, fmt.Errorf("token refresh: %w", err)
 		}
-		status, body, err = c.doUpload(filePath)
+		status, body, err = c.doUpload(ctx, filePath)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+
+	result, err := parseUploadResult(status, body)
+	if err != nil || !result.pending() {
+		return result, err
+	}
+	return c.pollUpload(ctx, result)
+}
+
+// getJSON performs an authenticated GET against the Connect API and decodes
+// the JSON response into v. Like UploadFIT it refreshes the OAuth2 token
+// when needed.
+func (c *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	status, body, err := c.get(ctx, path)
+	if err != nil {
+		return err
+	}
+	if status >= 400 {
+		return newHTTPError(status, body)
+	}
+	if status == 204 || len(body) == 0 {
+		return fmt.Errorf("no data (HTTP %d)", status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// get performs an authenticated GET against the Connect API, refreshing
+// the OAuth2 token when it is expired or rejected.
+func (c *Client) get(ctx context.Context, path string) (int, []byte, error) {
+	if c.OAuth2 == nil {
+		return 0, nil, fmt.Errorf("not authenticated")
+	}
+	if c.OAuth2.Expired() {
+		if err := c.refreshOAuth2(ctx); err != nil {
+			return 0, nil, fmt.Errorf("token refresh: %w", err)
+		}
+	}
+
+	status, body, err := c.doGet(ctx, path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if status == 401 {
+		if err := c.refreshOAuth2(ctx); err != nil {
+			return 0, nil, fmt.Errorf("token refresh: %w", err)
 		}
+		return c.doGet(ctx, path)
+	}
+	return status, body, nil
+}
+
+// doGet performs an authenticated GET and returns status + body.
+func (c *Client) doGet(ctx context.Context, path string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.apiBase()+path, nil)
+	if err != nil {
+		return 0, nil, err
 	}
+	c.setAPIHeaders(req)
 
-	return parseUploadResult(status, body)
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// setAPIHeaders sets the headers every Connect API request needs.
+func (c *Client) setAPIHeaders(req *http.Request) {
+	req.Header.Set("Authorization", c.OAuth2.Bearer())
+	req.Header.Set("User-Agent", c.agent(apiUserAgent))
+	req.Header.Set("DI-Backend", c.apiHost())
+	req.Header.Set("NK", "NT")
 }
 
 // refreshOAuth2 exchanges the OAuth1 token for a fresh OAuth2 token.
-func (c *Client) refreshOAuth2() error {
-	oauth2, err := ExchangeForOAuth2(c.OAuth1)
+func (c *Client) refreshOAuth2(ctx context.Context) error {
+	oauth2, err := c.exchangeForOAuth2(ctx, c.OAuth1)
 	if err != nil {
 		return err
 	}
@@ -131,7 +230,7 @@ func (c *Client) refreshOAuth2() error {
 }
 
 // doUpload performs the actual multipart upload and returns status + body.
-func (c *Client) doUpload(filePath string) (int, []byte, error) {
+func (c *Client) doUpload(ctx context.Context, filePath string) (int, []byte, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return 0, nil, err
@@ -150,19 +249,14 @@ func (c *Client) doUpload(filePath string) (int, []byte, error) {
 	}
 	writer.Close()
 
-	uploadURL := fmt.Sprintf("https://connectapi.%s/upload-service/upload", c.Domain)
-	req, err := http.NewRequest("POST", uploadURL, &buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.apiBase()+"/upload-service/upload", &buf)
 	if err != nil {
 		return 0, nil, err
 	}
-	req.Header.Set("Authorization", c.OAuth2.Bearer())
+	c.setAPIHeaders(req)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("User-Agent", apiUserAgent)
-	req.Header.Set("DI-Backend", fmt.Sprintf("connectapi.%s", c.Domain))
-	req.Header.Set("NK", "NT")
 
-	client := &http.Client{Timeout: 60 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := c.client().Do(req)
 	if err != nil {
 		return 0, nil, fmt.Errorf("upload request: %w", err)
 	}
@@ -176,29 +270,164 @@ func (c *Client) doUpload(filePath string) (int, []byte, error) {
 	return resp.StatusCode, body, nil
 }
 
-// parseUploadResult checks the upload response for errors.
-func parseUploadResult(status int, body []byte) error {
-	if status == 409 {
-		return fmt.Errorf("duplicate activity (already uploaded to Garmin)")
+// ---------------------------------------------------------------------------
+// Upload results
+// ---------------------------------------------------------------------------
+
+// UploadResult describes what Garmin Connect made of an uploaded file.
+type UploadResult struct {
+	UploadID    int64
+	UploadUUID  string
+	ActivityIDs []int64  // activities created, or the existing one for a duplicate
+	Messages    []string // messages Garmin attached to the upload
+
+	created  time.Time // upload creation time, needed to poll the status
+	rejected bool      // Garmin reported the file as failed or a duplicate
+}
+
+// pending reports whether Garmin is still processing the upload.
+func (r *UploadResult) pending() bool {
+	return len(r.ActivityIDs) == 0 && r.UploadUUID != ""
+}
+
+// uploadResponse is the JSON Garmin returns for an upload and its status.
+type uploadResponse struct {
+	DetailedImportResult struct {
+		UploadID   int64 `json:"uploadId"`
+		UploadUUID struct {
+			UUID string `json:"uuid"`
+		} `json:"uploadUuid"`
+		CreationDate string         `json:"creationDate"`
+		Successes    []uploadReport `json:"successes"`
+		Failures     []uploadReport `json:"failures"`
+	} `json:"detailedImportResult"`
+}
+
+type uploadReport struct {
+	InternalID int64 `json:"internalId"`
+	Messages   []struct {
+		Code    int    `json:"code"`
+		Content string `json:"content"`
+	} `json:"messages"`
+}
+
+// uploadCreationLayout is the format of detailedImportResult.creationDate,
+// e.g. "2024-05-01 18:30:12.543 GMT".
+const uploadCreationLayout = "2006-01-02 15:04:05.999 MST"
+
+// duplicateMessageCode is the code of Garmin's "Duplicate Activity."
+// failure message.
+const duplicateMessageCode = 202
+
+// Status polling: Garmin usually finishes within a few seconds.
+const (
+	uploadPollInterval = time.Second
+	uploadPollTimeout  = time.Minute
+)
+
+// parseUploadResult checks the upload (or upload status) response for
+// errors and returns the result it describes.
+func parseUploadResult(status int, body []byte) (*UploadResult, error) {
+	var resp uploadResponse
+	jsonErr := json.Unmarshal(body, &resp)
+	d := resp.DetailedImportResult
+
+	result := &UploadResult{
+		UploadID:   d.UploadID,
+		UploadUUID: d.UploadUUID.UUID,
+		rejected:   status == 409 || len(d.Failures) > 0,
 	}
-	if status >= 400 {
-		return fmt.Errorf("upload failed (HTTP %d): %s", status,
-			string(body[:min(300, len(body))]))
+	if t, err := time.Parse(uploadCreationLayout, d.CreationDate); err == nil {
+		result.created = t
+	}
+	for _, r := range d.Successes {
+		if r.InternalID != 0 {
+			result.ActivityIDs = append(result.ActivityIDs, r.InternalID)
+		}
+		for _, m := range r.Messages {
+			result.Messages = append(result.Messages, m.Content)
+		}
+	}
+	var failures []string
+	duplicate := status == 409
+	for _, r := range d.Failures {
+		for _, m := range r.Messages {
+			result.Messages = append(result.Messages, m.Content)
+			failures = append(failures, m.Content)
+			if m.Code == duplicateMessageCode {
+				duplicate = true
+			}
+		}
 	}
 
-	// Check for failures in the detailed result
-	var result struct {
-		DetailedImportResult struct {
-			Failures []interface{} `json:"failures"`
-			Successes []interface{} `json:"successes"`
-		} `json:"detailedImportResult"`
+	if duplicate {
+		// The failure points at the activity that is already there
+		for _, r := range d.Failures {
+			if r.InternalID != 0 {
+				result.ActivityIDs = append(result.ActivityIDs, r.InternalID)
+			}
+		}
+		e := newHTTPError(status, body)
+		e.Err, e.Message = ErrDuplicateActivity, ""
+		return result, e
 	}
-	if err := json.Unmarshal(body, &result); err == nil {
-		if len(result.DetailedImportResult.Failures) > 0 {
-			return fmt.Errorf("upload reported failures: %v",
-				result.DetailedImportResult.Failures)
+	if status >= 400 {
+		e := newHTTPError(status, body)
+		if e.Err == nil {
+			e.Err = ErrUploadRejected
 		}
+		return result, e
+	}
+	if jsonErr == nil && len(d.Failures) > 0 {
+		e := newHTTPError(status, body)
+		e.Err, e.Message = ErrUploadRejected, strings.Join(failures, "; ")
+		return result, e
 	}
 
-	return nil
+	return result, nil
+}
+
+// pollUpload polls the upload status until Garmin has created the
+// activity, and returns the final result. Garmin already has the file, so
+// when the status can't be had (a failed request, cancellation, or the
+// timeout) the accepted result is returned without an error.
+func (c *Client) pollUpload(ctx context.Context, result *UploadResult) (*UploadResult, error) {
+	if result.created.IsZero() {
+		// Without the creation date the status can't be asked for
+		return result, nil
+	}
+	path := fmt.Sprintf("/activity-service/activity/status/%d/%s",
+		result.created.UnixMilli(), url.PathEscape(result.UploadUUID))
+
+	deadline := time.Now().Add(uploadPollTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return result, nil
+		case <-time.After(uploadPollInterval):
+		}
+
+		status, body, err := c.get(ctx, path)
+		if err != nil {
+			return result, nil
+		}
+		if status == 202 {
+			continue // still processing
+		}
+		polled, err := parseUploadResult(status, body)
+		if polled.UploadID == 0 {
+			polled.UploadID = result.UploadID
+		}
+		if polled.UploadUUID == "" {
+			polled.UploadUUID = result.UploadUUID
+		}
+		polled.created = result.created
+		if err != nil && !polled.rejected {
+			return result, nil // the status request failed, not the upload
+		}
+		if err != nil || !polled.pending() {
+			return polled, err
+		}
+	}
+	return result, nil // still processing
 }
@@ -0,0 +1,205 @@
+package garmin_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mywhoosh2garmin/garmin"
+	"mywhoosh2garmin/garmin/garmintest"
+)
+
+// newTestClient starts a fake Garmin Connect and returns a client for it
+// that caches tokens in a temporary directory.
+func newTestClient(t *testing.T) (*garmin.Client, *garmintest.Server) {
+	t.Helper()
+	srv := garmintest.NewServer()
+	t.Cleanup(srv.Close)
+	return garmin.NewClient(t.TempDir(), srv.Options()...), srv
+}
+
+func login(t *testing.T, c *garmin.Client) {
+	t.Helper()
+	err := c.Login(context.Background(), garmintest.DefaultEmail, garmintest.DefaultPassword)
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+}
+
+// writeTestFile writes a stand-in FIT file; the fake doesn't parse it.
+func writeTestFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ride.fixed.fit")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoginAndUpload(t *testing.T) {
+	c, srv := newTestClient(t)
+	login(t, c)
+	if c.OAuth1 == nil || c.OAuth2 == nil || c.OAuth2.Expired() {
+		t.Fatalf("tokens after login: %+v, %+v", c.OAuth1, c.OAuth2)
+	}
+
+	ctx := context.Background()
+	path := writeTestFile(t, "ride one")
+	result, err := c.UploadFIT(ctx, path)
+	if err != nil {
+		t.Fatalf("UploadFIT: %v", err)
+	}
+	if result.UploadID == 0 || len(result.ActivityIDs) != 1 {
+		t.Errorf("result = %+v, want an upload ID and one activity", result)
+	}
+	if got := srv.Uploads(); len(got) != 1 || got[0] != "ride.fixed.fit" {
+		t.Errorf("server got uploads %q", got)
+	}
+
+	// The same ride again is a duplicate that points at the first activity.
+	again, err := c.UploadFIT(ctx, path)
+	if !errors.Is(err, garmin.ErrDuplicateActivity) {
+		t.Fatalf("second upload: got %v, want ErrDuplicateActivity", err)
+	}
+	var httpErr *garmin.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != 409 {
+		t.Errorf("second upload: got %#v, want an HTTP 409 error", err)
+	}
+	if len(again.ActivityIDs) != 1 || again.ActivityIDs[0] != result.ActivityIDs[0] {
+		t.Errorf("duplicate points at %v, want %v", again.ActivityIDs, result.ActivityIDs)
+	}
+}
+
+func TestResume(t *testing.T) {
+	c, srv := newTestClient(t)
+	ctx := context.Background()
+	if err := c.Resume(ctx); err == nil {
+		t.Fatal("Resume without cached tokens succeeded")
+	}
+	login(t, c)
+
+	resumed := garmin.NewClient(c.TokenDir, srv.Options()...)
+	if err := resumed.Resume(ctx); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if _, err := resumed.UploadFIT(ctx, writeTestFile(t, "ride")); err != nil {
+		t.Errorf("upload after resume: %v", err)
+	}
+}
+
+func TestLoginInvalidCredentials(t *testing.T) {
+	c, _ := newTestClient(t)
+	err := c.Login(context.Background(), garmintest.DefaultEmail, "wrong")
+	if !errors.Is(err, garmin.ErrInvalidCredentials) {
+		t.Errorf("got %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLoginMFA(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		name    string
+		prompt  garmin.MFAPrompt
+		wantErr error
+	}{
+		{"right code", func(context.Context) (string, error) { return "123456", nil }, nil},
+		{"wrong code", func(context.Context) (string, error) { return "000000", nil }, garmin.ErrInvalidCredentials},
+		{"no prompt", nil, garmin.ErrMFARequired},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, srv := newTestClient(t)
+			srv.MFACode = "123456"
+			c.PromptMFA = tt.prompt
+
+			err := c.Login(ctx, garmintest.DefaultEmail, garmintest.DefaultPassword)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && c.OAuth1.MFAToken == "" {
+				t.Error("no MFA token after an MFA login")
+			}
+		})
+	}
+}
+
+func TestUploadModes(t *testing.T) {
+	for _, tt := range []struct {
+		mode    garmintest.UploadMode
+		wantErr error
+	}{
+		{garmintest.UploadDuplicate, garmin.ErrDuplicateActivity},
+		{garmintest.UploadUnauthorized, garmin.ErrTokenExpired},
+		{garmintest.UploadRejected, garmin.ErrUploadRejected},
+		{garmintest.UploadRateLimited, garmin.ErrRateLimited},
+		{garmintest.UploadServerError, garmin.ErrServerError},
+	} {
+		t.Run(tt.wantErr.Error(), func(t *testing.T) {
+			c, srv := newTestClient(t)
+			srv.UploadMode = tt.mode
+			login(t, c)
+
+			_, err := c.UploadFIT(context.Background(), writeTestFile(t, "ride"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUploadAsync(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.UploadMode = garmintest.UploadAsync
+	login(t, c)
+
+	result, err := c.UploadFIT(context.Background(), writeTestFile(t, "ride"))
+	if err != nil {
+		t.Fatalf("UploadFIT: %v", err)
+	}
+	if len(result.ActivityIDs) != 1 || result.UploadID == 0 {
+		t.Errorf("result = %+v, want the activity from the upload status", result)
+	}
+}
+
+func TestUploadStatusUnavailable(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.UploadMode = garmintest.UploadStatusError
+	login(t, c)
+
+	// Garmin has the file: a failing status is no reason to upload it again
+	result, err := c.UploadFIT(context.Background(), writeTestFile(t, "ride"))
+	if err != nil {
+		t.Fatalf("UploadFIT: %v", err)
+	}
+	if result.UploadID == 0 || len(result.ActivityIDs) != 0 {
+		t.Errorf("result = %+v, want the accepted upload without activities", result)
+	}
+}
+
+func TestUploadRefreshesRejectedToken(t *testing.T) {
+	c, srv := newTestClient(t)
+	login(t, c)
+	srv.RevokeAccessTokens()
+
+	if _, err := c.UploadFIT(context.Background(), writeTestFile(t, "ride")); err != nil {
+		t.Fatalf("UploadFIT: %v", err)
+	}
+	if n := srv.Exchanges(); n != 2 {
+		t.Errorf("%d token exchanges, want 2 (login and refresh)", n)
+	}
+	if len(srv.Uploads()) != 1 {
+		t.Errorf("%d files received, want 1", len(srv.Uploads()))
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	c, _ := newTestClient(t)
+	login(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.UploadFIT(ctx, writeTestFile(t, "ride")); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,68 @@
+package garmin
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ---------------------------------------------------------------------------
+// Errors
+// ---------------------------------------------------------------------------
+
+// Kinds of failure callers may want to respond to. Check for them with
+// errors.Is; errors.As with *HTTPError gives the status and body.
+var (
+	ErrDuplicateActivity  = errors.New("duplicate activity (already uploaded to Garmin)")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrMFARequired        = errors.New("two-factor authentication required")
+	ErrTokenExpired       = errors.New("session expired or revoked")
+	ErrRateLimited        = errors.New("rate limited by Garmin")
+	ErrServerError        = errors.New("Garmin server error")
+	ErrUploadRejected     = errors.New("upload rejected")
+)
+
+// HTTPError is a request Garmin answered with a failure. It unwraps to
+// the Err* value for its kind, if it has one.
+type HTTPError struct {
+	StatusCode int
+	Body       string // response body, truncated
+	Message    string // what went wrong, if Garmin said
+	Err        error  // kind of failure, or nil
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("HTTP %d", e.StatusCode)
+	if e.Err != nil {
+		msg = fmt.Sprintf("%v (HTTP %d)", e.Err, e.StatusCode)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// maxErrorBody is how much of a response body an HTTPError keeps.
+const maxErrorBody = 300
+
+// newHTTPError classifies a failed response by its status code. The
+// body becomes the message when the status says nothing more specific.
+func newHTTPError(status int, body []byte) *HTTPError {
+	e := &HTTPError{StatusCode: status, Body: string(body[:min(maxErrorBody, len(body))])}
+	switch {
+	case status == 401:
+		e.Err = ErrTokenExpired
+	case status == 409:
+		e.Err = ErrDuplicateActivity
+	case status == 429:
+		e.Err = ErrRateLimited
+	case status >= 500:
+		e.Err = ErrServerError
+	default:
+		e.Message = e.Body
+	}
+	return e
+}
@@ -0,0 +1,450 @@
+// Package garmintest runs a fake Garmin Connect on a local httptest server,
+// for end-to-end tests of code that logs in and uploads with the garmin
+// package.
+//
+// One server stands in for all endpoints: the OAuth consumer JSON, the SSO
+// embed, signin and MFA pages, the OAuth1 preauthorized and OAuth2 exchange
+// endpoints, and the upload and upload status services.
+package garmintest
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mywhoosh2garmin/garmin"
+)
+
+// Credentials the fake accepts unless changed on the Server.
+const (
+	DefaultEmail    = "rider@example.com"
+	DefaultPassword = "secret"
+)
+
+// The consumer the fake hands out, and checks OAuth1 signatures against.
+const (
+	ConsumerKey    = "fake-consumer-key"
+	ConsumerSecret = "fake-consumer-secret"
+)
+
+// UploadMode selects how the upload service answers.
+type UploadMode int
+
+const (
+	// UploadOK creates the activity right away (HTTP 201). A file whose
+	// content was uploaded before is answered as a duplicate.
+	UploadOK UploadMode = iota
+
+	// UploadAsync accepts the file for processing (HTTP 202); the upload
+	// status reports the activity on the first poll.
+	UploadAsync
+
+	// UploadDuplicate answers every upload as a duplicate (HTTP 409).
+	UploadDuplicate
+
+	// UploadUnauthorized rejects every access token (HTTP 401).
+	UploadUnauthorized
+
+	// UploadRejected accepts the request but reports the file as
+	// unprocessable in the import result.
+	UploadRejected
+
+	// UploadRateLimited answers HTTP 429.
+	UploadRateLimited
+
+	// UploadServerError answers HTTP 500.
+	UploadServerError
+
+	// UploadStatusError accepts the file like UploadAsync, but the upload
+	// status answers HTTP 500.
+	UploadStatusError
+)
+
+// mfaTitle is the page title Garmin shows with the MFA challenge.
+const mfaTitle = "GARMIN > MFA Challenge"
+
+// Server is a fake Garmin Connect. Set its fields before the code under
+// test talks to it.
+type Server struct {
+	*httptest.Server
+
+	Email    string
+	Password string
+
+	// MFACode, when set, makes the login ask for this two-factor code.
+	MFACode string
+
+	// UploadMode selects how uploads are answered. Defaults to UploadOK.
+	UploadMode UploadMode
+
+	mu         sync.Mutex
+	nextID     int64
+	csrf       string
+	tickets    map[string]bool
+	oauth1     map[string]bool  // issued OAuth1 tokens
+	access     map[string]bool  // valid OAuth2 access tokens
+	activities map[string]int64 // activity ID by uploaded content hash
+	pending    map[string]int64 // async uploads by UUID: their activity ID
+	uploads    []string
+	exchanges  int
+}
+
+// NewServer starts a fake Garmin Connect. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		Email:      DefaultEmail,
+		Password:   DefaultPassword,
+		nextID:     1000,
+		tickets:    map[string]bool{},
+		oauth1:     map[string]bool{},
+		access:     map[string]bool{},
+		activities: map[string]int64{},
+		pending:    map[string]int64{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth_consumer.json", s.consumer)
+	mux.HandleFunc("GET /sso/embed", s.embed)
+	mux.HandleFunc("GET /sso/signin", s.signinPage)
+	mux.HandleFunc("POST /sso/signin", s.signin)
+	mux.HandleFunc("POST /sso/verifyMFA/loginEnterMfaCode", s.verifyMFA)
+	mux.HandleFunc("GET /oauth-service/oauth/preauthorized", s.preauthorized)
+	mux.HandleFunc("POST /oauth-service/oauth/exchange/user/2.0", s.exchange)
+	mux.HandleFunc("POST /upload-service/upload", s.upload)
+	mux.HandleFunc("GET /activity-service/activity/status/{created}/{uuid}", s.uploadStatus)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Options points a garmin.Client at the server.
+func (s *Server) Options() []garmin.Option {
+	return []garmin.Option{
+		garmin.WithHTTPClient(s.Client()),
+		garmin.WithSSOURL(s.URL),
+		garmin.WithAPIURL(s.URL),
+		garmin.WithConsumerURL(s.URL + "/oauth_consumer.json"),
+	}
+}
+
+// Uploads returns the names of the files received so far, including
+// duplicates and rejected files. Requests without a valid token don't
+// count.
+func (s *Server) Uploads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.uploads...)
+}
+
+// Exchanges returns how many OAuth2 tokens were handed out.
+func (s *Server) Exchanges() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exchanges
+}
+
+// RevokeAccessTokens makes the server reject every OAuth2 token handed out
+// so far, as if they had expired early. OAuth1 tokens stay valid.
+func (s *Server) RevokeAccessTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.access = map[string]bool{}
+}
+
+func (s *Server) newID() int64 {
+	s.nextID++
+	return s.nextID
+}
+
+// ---------------------------------------------------------------------------
+// OAuth consumer and SSO pages
+// ---------------------------------------------------------------------------
+
+func (s *Server) consumer(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"consumer_key":    ConsumerKey,
+		"consumer_secret": ConsumerSecret,
+	})
+}
+
+func (s *Server) embed(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "GARMIN-SSO", Value: "1", Path: "/"})
+	writePage(w, "GARMIN Authentication Application", "")
+}
+
+func (s *Server) signinPage(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie("GARMIN-SSO"); err != nil {
+		http.Error(w, "no SSO session", http.StatusForbidden)
+		return
+	}
+	writePage(w, "GARMIN Authentication Application", s.csrfField())
+}
+
+func (s *Server) signin(w http.ResponseWriter, r *http.Request) {
+	if !s.checkCSRF(r) {
+		http.Error(w, "bad CSRF token", http.StatusForbidden)
+		return
+	}
+	if r.PostForm.Get("username") != s.Email || r.PostForm.Get("password") != s.Password {
+		writePage(w, "GARMIN Authentication Application", s.csrfField())
+		return
+	}
+	if s.MFACode != "" {
+		writePage(w, mfaTitle, s.csrfField())
+		return
+	}
+	s.writeSuccess(w)
+}
+
+func (s *Server) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	if !s.checkCSRF(r) {
+		http.Error(w, "bad CSRF token", http.StatusForbidden)
+		return
+	}
+	if r.PostForm.Get("mfa-code") != s.MFACode {
+		writePage(w, mfaTitle, s.csrfField())
+		return
+	}
+	s.writeSuccess(w)
+}
+
+// csrfField issues a fresh CSRF token as the hidden form field.
+func (s *Server) csrfField() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.csrf = fmt.Sprintf("csrf-%d", s.newID())
+	return fmt.Sprintf(`<input type="hidden" name="_csrf" value="%s" />`, s.csrf)
+}
+
+func (s *Server) checkCSRF(r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.csrf != "" && r.PostForm.Get("_csrf") == s.csrf
+}
+
+// writeSuccess answers a completed login with a page carrying the ticket.
+func (s *Server) writeSuccess(w http.ResponseWriter) {
+	s.mu.Lock()
+	ticket := fmt.Sprintf("ST-%d-fake", s.newID())
+	s.tickets[ticket] = true
+	s.mu.Unlock()
+
+	script := fmt.Sprintf(`<script>var response_url = "%s/sso/embed?ticket=%s";</script>`, s.URL, ticket)
+	writePage(w, "Success", script)
+}
+
+func writePage(w http.ResponseWriter, title, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>%s</body></html>", title, body)
+}
+
+// ---------------------------------------------------------------------------
+// OAuth1 and OAuth2 tokens
+// ---------------------------------------------------------------------------
+
+func (s *Server) preauthorized(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+	if params["oauth_consumer_key"] != ConsumerKey || params["oauth_signature"] == "" {
+		http.Error(w, "bad OAuth1 signature", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket := r.URL.Query().Get("ticket")
+	if !s.tickets[ticket] {
+		http.Error(w, "unknown ticket", http.StatusUnauthorized)
+		return
+	}
+	delete(s.tickets, ticket) // tickets are single use
+
+	token := fmt.Sprintf("oauth1-%d", s.newID())
+	s.oauth1[token] = true
+	values := url.Values{
+		"oauth_token":        {token},
+		"oauth_token_secret": {token + "-secret"},
+	}
+	if s.MFACode != "" {
+		values.Set("mfa_token", fmt.Sprintf("mfa-%d", s.newID()))
+		values.Set("mfa_expiration_timestamp", time.Now().AddDate(1, 0, 0).Format("2006-01-02 15:04:05.000"))
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, values.Encode())
+}
+
+func (s *Server) exchange(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if params["oauth_consumer_key"] != ConsumerKey || !s.oauth1[params["oauth_token"]] {
+		http.Error(w, "bad OAuth1 token", http.StatusUnauthorized)
+		return
+	}
+
+	s.exchanges++
+	token := fmt.Sprintf("access-%d", s.newID())
+	s.access[token] = true
+	writeJSON(w, http.StatusOK, map[string]any{
+		"scope":                    "CONNECT_READ CONNECT_WRITE",
+		"jti":                      fmt.Sprintf("jti-%d", s.newID()),
+		"token_type":               "Bearer",
+		"access_token":             token,
+		"refresh_token":            "refresh-" + token,
+		"expires_in":               3600,
+		"refresh_token_expires_in": 7200,
+	})
+}
+
+// oauthParams returns the parameters of an OAuth1 Authorization header.
+func oauthParams(r *http.Request) map[string]string {
+	params := map[string]string{}
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "OAuth ")
+	if !ok {
+		return params
+	}
+	for _, kv := range strings.Split(auth, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			continue
+		}
+		v, _ = url.QueryUnescape(strings.Trim(v, `"`))
+		params[k] = v
+	}
+	return params
+}
+
+// ---------------------------------------------------------------------------
+// Upload service
+// ---------------------------------------------------------------------------
+
+// creationLayout is the format of detailedImportResult.creationDate.
+const creationLayout = "2006-01-02 15:04:05.000 MST"
+
+type importMessage struct {
+	Code    int    `json:"code"`
+	Content string `json:"content"`
+}
+
+type importReport struct {
+	InternalID *int64          `json:"internalId"`
+	Messages   []importMessage `json:"messages"`
+}
+
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "no file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads = append(s.uploads, header.Filename)
+
+	uploadID := s.newID()
+	uuid := fmt.Sprintf("uuid-%d", uploadID)
+	result := map[string]any{
+		"uploadId":     uploadID,
+		"uploadUuid":   map[string]string{"uuid": uuid},
+		"creationDate": time.Now().UTC().Format(creationLayout),
+		"fileName":     header.Filename,
+		"successes":    []importReport{},
+		"failures":     []importReport{},
+	}
+
+	existing, duplicate := s.activities[sum]
+	switch {
+	case s.UploadMode == UploadRateLimited:
+		http.Error(w, "", http.StatusTooManyRequests)
+		return
+	case s.UploadMode == UploadServerError:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	case s.UploadMode == UploadDuplicate || duplicate:
+		if !duplicate {
+			existing = s.newID()
+		}
+		result["failures"] = []importReport{{
+			InternalID: &existing,
+			Messages:   []importMessage{{Code: 202, Content: "Duplicate Activity."}},
+		}}
+		writeJSON(w, http.StatusConflict, map[string]any{"detailedImportResult": result})
+	case s.UploadMode == UploadRejected:
+		result["failures"] = []importReport{{
+			Messages: []importMessage{{Code: 100, Content: "Unable to process file."}},
+		}}
+		writeJSON(w, http.StatusAccepted, map[string]any{"detailedImportResult": result})
+	case s.UploadMode == UploadAsync || s.UploadMode == UploadStatusError:
+		id := s.newID()
+		s.activities[sum] = id
+		s.pending[uuid] = id
+		writeJSON(w, http.StatusAccepted, map[string]any{"detailedImportResult": result})
+	default:
+		id := s.newID()
+		s.activities[sum] = id
+		result["successes"] = []importReport{{InternalID: &id}}
+		writeJSON(w, http.StatusCreated, map[string]any{"detailedImportResult": result})
+	}
+}
+
+func (s *Server) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.UploadMode == UploadStatusError {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	uuid := r.PathValue("uuid")
+	id, ok := s.pending[uuid]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	delete(s.pending, uuid)
+	writeJSON(w, http.StatusCreated, map[string]any{"detailedImportResult": map[string]any{
+		"uploadUuid": map[string]string{"uuid": uuid},
+		"successes":  []importReport{{InternalID: &id}},
+		"failures":   []importReport{},
+	}})
+}
+
+// authorized checks the request's Bearer token. In UploadUnauthorized
+// mode no token is good.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return ok && s.access[token] && s.UploadMode != UploadUnauthorized
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
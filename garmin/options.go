@@ -0,0 +1,101 @@
+package garmin
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ---------------------------------------------------------------------------
+// Client options
+// ---------------------------------------------------------------------------
+
+// defaultConsumerURL serves the OAuth consumer key and secret of the
+// Garmin Connect app.
+const defaultConsumerURL = "https://thegarth.s3.amazonaws.com/oauth_consumer.json"
+
+// Option configures a Client created with NewClient.
+type Option func(*Client)
+
+// WithHTTPClient sends all requests through hc, e.g. one that goes through
+// a proxy or trusts a custom CA. The SSO login adds its own cookie jar.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTransport sends all requests through rt.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		hc := *c.client()
+		hc.Transport = rt
+		c.httpClient = &hc
+	}
+}
+
+// WithSSOURL sets the base URL of the SSO server, by default
+// https://sso.<domain>.
+func WithSSOURL(u string) Option {
+	return func(c *Client) { c.ssoURL = strings.TrimRight(u, "/") }
+}
+
+// WithAPIURL sets the base URL of the Connect API, by default
+// https://connectapi.<domain>.
+func WithAPIURL(u string) Option {
+	return func(c *Client) { c.apiURL = strings.TrimRight(u, "/") }
+}
+
+// WithConsumerURL sets where the OAuth consumer credentials are fetched
+// from.
+func WithConsumerURL(u string) Option {
+	return func(c *Client) { c.consumerURL = u }
+}
+
+// WithUserAgent sets the User-Agent of all requests, instead of the
+// Garmin Connect app's.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+func (c *Client) client() *http.Client {
+	if c.httpClient != nil {
+		return c.httpClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) ssoBase() string {
+	if c.ssoURL != "" {
+		return c.ssoURL
+	}
+	return "https://sso." + c.Domain
+}
+
+func (c *Client) apiBase() string {
+	if c.apiURL != "" {
+		return c.apiURL
+	}
+	return "https://connectapi." + c.Domain
+}
+
+// apiHost is the API host name, which Garmin also wants in DI-Backend.
+func (c *Client) apiHost() string {
+	if u, err := url.Parse(c.apiBase()); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "connectapi." + c.Domain
+}
+
+func (c *Client) consumerSource() string {
+	if c.consumerURL != "" {
+		return c.consumerURL
+	}
+	return defaultConsumerURL
+}
+
+// agent returns the configured user agent, or def.
+func (c *Client) agent(def string) string {
+	if c.userAgent != "" {
+		return c.userAgent
+	}
+	return def
+}
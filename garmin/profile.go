@@ -0,0 +1,79 @@
+package garmin
+
+import (
+	"context"
+	"fmt"
+)
+
+// AthleteProfile holds the training thresholds and body data Garmin Connect
+// has for the user. Values Garmin doesn't know are zero.
+type AthleteProfile struct {
+	FTP         int     // functional threshold power (cycling), W
+	MaxHR       int     // max heart rate, bpm
+	RestingHR   int     // resting heart rate, bpm
+	ThresholdHR int     // lactate threshold heart rate, bpm
+	WeightKg    float64 // body weight, kg
+}
+
+// AthleteProfile fetches the user's thresholds and weight from Garmin
+// Connect. It returns whatever could be fetched; the error is only set when
+// nothing could.
+func (c *Client) AthleteProfile(ctx context.Context) (*AthleteProfile, error) {
+	var p AthleteProfile
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var settings struct {
+		UserData struct {
+			Weight                    float64 `json:"weight"` // grams
+			LactateThresholdHeartRate int     `json:"lactateThresholdHeartRate"`
+		} `json:"userData"`
+	}
+	if err := c.getJSON(ctx, "/userprofile-service/userprofile/user-settings", &settings); err != nil {
+		keep(fmt.Errorf("user settings: %w", err))
+	} else {
+		p.WeightKg = settings.UserData.Weight / 1000
+		p.ThresholdHR = settings.UserData.LactateThresholdHeartRate
+	}
+
+	var ftp struct {
+		FunctionalThresholdPower float64 `json:"functionalThresholdPower"`
+	}
+	if err := c.getJSON(ctx, "/biometric-service/biometric/latestFunctionalThresholdPower/CYCLING", &ftp); err != nil {
+		keep(fmt.Errorf("FTP: %w", err))
+	} else {
+		p.FTP = int(ftp.FunctionalThresholdPower)
+	}
+
+	var zones []struct {
+		Sport                         string `json:"sport"`
+		MaxHeartRateUsed              int    `json:"maxHeartRateUsed"`
+		RestingHeartRateUsed          int    `json:"restingHeartRateUsed"`
+		LactateThresholdHeartRateUsed int    `json:"lactateThresholdHeartRateUsed"`
+	}
+	if err := c.getJSON(ctx, "/biometric-service/heartRateZones", &zones); err != nil {
+		keep(fmt.Errorf("heart rate zones: %w", err))
+	} else {
+		// Prefer the cycling zones, fall back to the default ones.
+		for _, sport := range []string{"CYCLING", "DEFAULT"} {
+			for _, z := range zones {
+				if z.Sport == sport && p.MaxHR == 0 {
+					p.MaxHR = z.MaxHeartRateUsed
+					p.RestingHR = z.RestingHeartRateUsed
+					if p.ThresholdHR == 0 {
+						p.ThresholdHR = z.LactateThresholdHeartRateUsed
+					}
+				}
+			}
+		}
+	}
+
+	if p == (AthleteProfile{}) && firstErr != nil {
+		return nil, firstErr
+	}
+	return &p, nil
+}
@@ -3,6 +3,7 @@ package garmin
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,10 +16,7 @@ import (
 	"github.com/dghubble/oauth1"
 )
 
-const (
-	oauthConsumerURL = "https://thegarth.s3.amazonaws.com/oauth_consumer.json"
-	ssoUserAgent     = "com.garmin.android.apps.connectmobile"
-)
+const ssoUserAgent = "com.garmin.android.apps.connectmobile"
 
 var (
 	csrfRe   = regexp.MustCompile(`name="_csrf"\s+value="(.+?)"`)
@@ -26,6 +24,11 @@ var (
 	ticketRe = regexp.MustCompile(`embed\?ticket=([^"]+)"`)
 )
 
+// MFAPrompt asks the user for the one-time code of a two-factor login,
+// e.g. from an authenticator app, email or text message. It should give
+// up with ctx.Err() when ctx is done.
+type MFAPrompt func(ctx context.Context) (string, error)
+
 type oauthConsumer struct {
 	ConsumerKey    string `json:"consumer_key"`
 	ConsumerSecret string `json:"consumer_secret"`
@@ -34,26 +37,36 @@ type oauthConsumer struct {
 // ssoSession tracks cookies and the last response URL (for Referer headers)
 // across the multi-step Garmin SSO flow.
 type ssoSession struct {
-	client  *http.Client
-	lastURL string
+	client    *http.Client
+	userAgent string
+	lastURL   string
 }
 
-func newSSOSession() *ssoSession {
+// newSSOSession starts a session on the client's HTTP client, with a
+// cookie jar of its own.
+func (c *Client) newSSOSession() *ssoSession {
 	jar, _ := cookiejar.New(nil)
-	return &ssoSession{
-		client: &http.Client{
-			Jar:     jar,
-			Timeout: 30 * time.Second,
-		},
+	hc := *c.client()
+	hc.Jar = jar
+	return &ssoSession{client: &hc, userAgent: c.agent(ssoUserAgent)}
+}
+
+// ssoHTTPError classifies a failed SSO response. The SSO pages answer
+// 401 to bad credentials rather than to an expired session.
+func ssoHTTPError(status int, body []byte) *HTTPError {
+	e := newHTTPError(status, body)
+	if errors.Is(e.Err, ErrTokenExpired) {
+		e.Err = ErrInvalidCredentials
 	}
+	return e
 }
 
-func (s *ssoSession) get(reqURL string, useReferer bool) (string, error) {
-	req, err := http.NewRequest("GET", reqURL, nil)
+func (s *ssoSession) get(ctx context.Context, reqURL string, useReferer bool) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", ssoUserAgent)
+	req.Header.Set("User-Agent", s.userAgent)
 	if useReferer && s.lastURL != "" {
 		req.Header.Set("Referer", s.lastURL)
 	}
@@ -68,18 +81,17 @@ func (s *ssoSession) get(reqURL string, useReferer bool) (string, error) {
 		return "", err
 	}
 	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode,
-			string(body[:min(300, len(body))]))
+		return "", ssoHTTPError(resp.StatusCode, body)
 	}
 	return string(body), nil
 }
 
-func (s *ssoSession) post(reqURL string, form url.Values, useReferer bool) (string, error) {
-	req, err := http.NewRequest("POST", reqURL, strings.NewReader(form.Encode()))
+func (s *ssoSession) post(ctx context.Context, reqURL string, form url.Values, useReferer bool) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", ssoUserAgent)
+	req.Header.Set("User-Agent", s.userAgent)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	if useReferer && s.lastURL != "" {
 		req.Header.Set("Referer", s.lastURL)
@@ -95,28 +107,45 @@ func (s *ssoSession) post(reqURL string, form url.Values, useReferer bool) (stri
 		return "", err
 	}
 	if resp.StatusCode >= 400 {
-		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode,
-			string(body[:min(300, len(body))]))
+		return "", ssoHTTPError(resp.StatusCode, body)
 	}
 	return string(body), nil
 }
 
 // Login performs the full Garmin SSO login flow and returns OAuth tokens.
-func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
-	if domain == "" {
-		domain = "garmin.com"
+// promptMFA is asked for the code when Garmin challenges for two-factor
+// authentication; it may be nil for accounts without MFA. It uses the
+// default endpoints and transport; Client.Login honours the client options.
+func Login(ctx context.Context, email, password, domain string, promptMFA MFAPrompt) (*OAuth1Token, *OAuth2Token, error) {
+	c := NewClient("")
+	if domain != "" {
+		c.Domain = domain
+	}
+	c.PromptMFA = promptMFA
+	return c.login(ctx, email, password)
+}
+
+// ExchangeForOAuth2 refreshes the OAuth2 token using an existing OAuth1 token.
+func ExchangeForOAuth2(ctx context.Context, oauth1Token *OAuth1Token) (*OAuth2Token, error) {
+	c := NewClient("")
+	if oauth1Token.Domain != "" {
+		c.Domain = oauth1Token.Domain
 	}
+	return c.exchangeForOAuth2(ctx, oauth1Token)
+}
 
+// login performs the SSO login flow against the client's endpoints.
+func (c *Client) login(ctx context.Context, email, password string) (*OAuth1Token, *OAuth2Token, error) {
 	// 1. Fetch OAuth consumer credentials from Garmin's S3 bucket
-	consumer, err := fetchConsumer()
+	consumer, err := c.fetchConsumer(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("fetch consumer: %w", err)
 	}
 
 	// 2. Start SSO session with cookie jar
-	sess := newSSOSession()
+	sess := c.newSSOSession()
 
-	ssoBase := fmt.Sprintf("https://sso.%s", domain)
+	ssoBase := c.ssoBase()
 	ssoEmbed := ssoBase + "/sso/embed"
 
 	embedParams := url.Values{
@@ -135,14 +164,14 @@ func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
 	}
 
 	// 3. GET /sso/embed — set cookies
-	_, err = sess.get(ssoEmbed+"?"+embedParams.Encode(), false)
+	_, err = sess.get(ctx, ssoEmbed+"?"+embedParams.Encode(), false)
 	if err != nil {
 		return nil, nil, fmt.Errorf("sso embed: %w", err)
 	}
 
 	// 4. GET /sso/signin — extract CSRF token
 	signinURL := ssoBase + "/sso/signin?" + signinParams.Encode()
-	body, err := sess.get(signinURL, true)
+	body, err := sess.get(ctx, signinURL, true)
 	if err != nil {
 		return nil, nil, fmt.Errorf("sso signin page: %w", err)
 	}
@@ -161,6 +190,7 @@ func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
 	}
 
 	body, err = sess.post(
+		ctx,
 		ssoBase+"/sso/signin?"+signinParams.Encode(),
 		formData,
 		true,
@@ -169,20 +199,26 @@ func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
 		return nil, nil, fmt.Errorf("sso login: %w", err)
 	}
 
-	// 6. Check result title
-	titleMatch := titleRe.FindStringSubmatch(body)
-	if titleMatch == nil {
-		return nil, nil, fmt.Errorf("no title in response — login may have failed")
+	// 6. Check result title, answering the MFA challenge if there is one
+	title, err := ssoTitle(body)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	title := titleMatch[1]
 	if strings.Contains(title, "MFA") {
-		return nil, nil, fmt.Errorf(
-			"MFA is required but not yet supported in this tool.\n" +
-				"  Disable MFA temporarily, or use the Python version")
+		body, err = verifyMFA(ctx, sess, ssoBase, signinParams, body, c.PromptMFA)
+		if err != nil {
+			return nil, nil, err
+		}
+		title, err = ssoTitle(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if title != "Success" {
+			return nil, nil, fmt.Errorf("MFA verification failed: %q (check the code): %w", title, ErrInvalidCredentials)
+		}
 	}
 	if title != "Success" {
-		return nil, nil, fmt.Errorf("login failed: %q (check credentials)", title)
+		return nil, nil, fmt.Errorf("login failed: %q (check credentials): %w", title, ErrInvalidCredentials)
 	}
 
 	// 7. Parse ticket from response
@@ -193,13 +229,13 @@ func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
 	ticket := ticketMatch[1]
 
 	// 8. Get OAuth1 token via OAuth1-signed request
-	oauth1Token, err := getOAuth1Token(consumer, ticket, domain)
+	oauth1Token, err := c.getOAuth1Token(ctx, consumer, ticket)
 	if err != nil {
 		return nil, nil, fmt.Errorf("oauth1 token: %w", err)
 	}
 
 	// 9. Exchange OAuth1 for OAuth2 Bearer token
-	oauth2Token, err := exchangeOAuth2(consumer, oauth1Token, domain)
+	oauth2Token, err := c.exchangeOAuth2(ctx, consumer, oauth1Token)
 	if err != nil {
 		return nil, nil, fmt.Errorf("oauth2 exchange: %w", err)
 	}
@@ -207,58 +243,111 @@ func Login(email, password, domain string) (*OAuth1Token, *OAuth2Token, error) {
 	return oauth1Token, oauth2Token, nil
 }
 
-// ExchangeForOAuth2 refreshes the OAuth2 token using an existing OAuth1 token.
-func ExchangeForOAuth2(oauth1Token *OAuth1Token) (*OAuth2Token, error) {
-	consumer, err := fetchConsumer()
+// exchangeForOAuth2 gets a fresh OAuth2 token for the OAuth1 token.
+func (c *Client) exchangeForOAuth2(ctx context.Context, oauth1Token *OAuth1Token) (*OAuth2Token, error) {
+	consumer, err := c.fetchConsumer(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("fetch consumer: %w", err)
 	}
-	domain := oauth1Token.Domain
-	if domain == "" {
-		domain = "garmin.com"
-	}
-	return exchangeOAuth2(consumer, oauth1Token, domain)
+	return c.exchangeOAuth2(ctx, consumer, oauth1Token)
 }
 
 // ---------------------------------------------------------------------------
 // Internal helpers
 // ---------------------------------------------------------------------------
 
-func fetchConsumer() (*oauthConsumer, error) {
-	resp, err := http.Get(oauthConsumerURL)
+// oauth1Context makes the OAuth1-signing client send its requests
+// through the client's transport.
+func (c *Client) oauth1Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth1.HTTPClient, c.client())
+}
+
+// ssoTitle returns the title of an SSO page, which tells how a step went.
+func ssoTitle(body string) (string, error) {
+	m := titleRe.FindStringSubmatch(body)
+	if m == nil {
+		return "", fmt.Errorf("no title in response — login may have failed")
+	}
+	return m[1], nil
+}
+
+// verifyMFA answers the MFA challenge page with a code from prompt and
+// returns the page Garmin responds with.
+func verifyMFA(ctx context.Context, sess *ssoSession, ssoBase string, signinParams url.Values, page string, prompt MFAPrompt) (string, error) {
+	if prompt == nil {
+		return "", fmt.Errorf("%w, but there is no way to ask for the code", ErrMFARequired)
+	}
+
+	csrf := csrfRe.FindStringSubmatch(page)
+	if csrf == nil {
+		return "", fmt.Errorf("CSRF token not found in MFA page")
+	}
+
+	code, err := prompt(ctx)
+	if err != nil {
+		return "", fmt.Errorf("read MFA code: %w", err)
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return "", fmt.Errorf("no MFA code entered")
+	}
+
+	formData := url.Values{
+		"mfa-code": {code},
+		"embed":    {"true"},
+		"_csrf":    {csrf[1]},
+		"fromPage": {"setupEnterMfaCode"},
+	}
+	body, err := sess.post(
+		ctx,
+		ssoBase+"/sso/verifyMFA/loginEnterMfaCode?"+signinParams.Encode(),
+		formData,
+		true,
+	)
+	if err != nil {
+		return "", fmt.Errorf("sso verify MFA: %w", err)
+	}
+	return body, nil
+}
+
+func (c *Client) fetchConsumer(ctx context.Context) (*oauthConsumer, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.consumerSource(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.agent(ssoUserAgent))
+	resp, err := c.client().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("consumer fetch HTTP %d", resp.StatusCode)
+		return nil, fmt.Errorf("consumer fetch: %w", newHTTPError(resp.StatusCode, nil))
 	}
-	var c oauthConsumer
-	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+	var consumer oauthConsumer
+	if err := json.NewDecoder(resp.Body).Decode(&consumer); err != nil {
 		return nil, err
 	}
-	return &c, nil
+	return &consumer, nil
 }
 
-func getOAuth1Token(consumer *oauthConsumer, ticket, domain string) (*OAuth1Token, error) {
+func (c *Client) getOAuth1Token(ctx context.Context, consumer *oauthConsumer, ticket string) (*OAuth1Token, error) {
 	// OAuth1 signed with consumer-only (empty token)
 	config := oauth1.NewConfig(consumer.ConsumerKey, consumer.ConsumerSecret)
 	token := oauth1.NewToken("", "")
-	httpClient := config.Client(context.Background(), token)
-	httpClient.Timeout = 30 * time.Second
+	httpClient := config.Client(c.oauth1Context(ctx), token)
 
-	apiBase := fmt.Sprintf("https://connectapi.%s", domain)
-	loginURL := fmt.Sprintf("https://sso.%s/sso/embed", domain)
+	loginURL := c.ssoBase() + "/sso/embed"
 	reqURL := fmt.Sprintf(
 		"%s/oauth-service/oauth/preauthorized?ticket=%s&login-url=%s&accepts-mfa-tokens=true",
-		apiBase, url.QueryEscape(ticket), url.QueryEscape(loginURL),
+		c.apiBase(), url.QueryEscape(ticket), url.QueryEscape(loginURL),
 	)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", ssoUserAgent)
+	req.Header.Set("User-Agent", c.agent(ssoUserAgent))
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -271,8 +360,7 @@ func getOAuth1Token(consumer *oauthConsumer, ticket, domain string) (*OAuth1Toke
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("preauthorized HTTP %d: %s", resp.StatusCode,
-			string(body[:min(300, len(body))]))
+		return nil, fmt.Errorf("preauthorized: %w", newHTTPError(resp.StatusCode, body))
 	}
 
 	values, err := url.ParseQuery(string(body))
@@ -285,30 +373,28 @@ func getOAuth1Token(consumer *oauthConsumer, ticket, domain string) (*OAuth1Toke
 		OAuthTokenSecret: values.Get("oauth_token_secret"),
 		MFAToken:         values.Get("mfa_token"),
 		MFAExpiration:    values.Get("mfa_expiration_timestamp"),
-		Domain:           domain,
+		Domain:           c.Domain,
 	}, nil
 }
 
-func exchangeOAuth2(consumer *oauthConsumer, oauth1Token *OAuth1Token, domain string) (*OAuth2Token, error) {
+func (c *Client) exchangeOAuth2(ctx context.Context, consumer *oauthConsumer, oauth1Token *OAuth1Token) (*OAuth2Token, error) {
 	// OAuth1 signed with consumer + token
 	config := oauth1.NewConfig(consumer.ConsumerKey, consumer.ConsumerSecret)
 	token := oauth1.NewToken(oauth1Token.OAuthToken, oauth1Token.OAuthTokenSecret)
-	httpClient := config.Client(context.Background(), token)
-	httpClient.Timeout = 30 * time.Second
+	httpClient := config.Client(c.oauth1Context(ctx), token)
 
-	apiBase := fmt.Sprintf("https://connectapi.%s", domain)
-	reqURL := fmt.Sprintf("%s/oauth-service/oauth/exchange/user/2.0", apiBase)
+	reqURL := c.apiBase() + "/oauth-service/oauth/exchange/user/2.0"
 
 	var bodyContent string
 	if oauth1Token.MFAToken != "" {
 		bodyContent = "mfa_token=" + url.QueryEscape(oauth1Token.MFAToken)
 	}
 
-	req, err := http.NewRequest("POST", reqURL, strings.NewReader(bodyContent))
+	req, err := http.NewRequestWithContext(ctx, "POST", reqURL, strings.NewReader(bodyContent))
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("User-Agent", ssoUserAgent)
+	req.Header.Set("User-Agent", c.agent(ssoUserAgent))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := httpClient.Do(req)
@@ -322,8 +408,7 @@ func exchangeOAuth2(consumer *oauthConsumer, oauth1Token *OAuth1Token, domain st
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("exchange HTTP %d: %s", resp.StatusCode,
-			string(respBody[:min(300, len(respBody))]))
+		return nil, fmt.Errorf("exchange: %w", newHTTPError(resp.StatusCode, respBody))
 	}
 
 	// Parse the exchange response (contains expires_in but not expires_at)
@@ -7,7 +7,9 @@ toolchain go1.24.13
 require (
 	fyne.io/fyne/v2 v2.7.2
 	github.com/dghubble/oauth1 v0.7.3
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/muktihari/fit v0.27.1
+	golang.org/x/term v0.39.0
 )
 
 require (
@@ -15,7 +17,6 @@ require (
 	github.com/BurntSushi/toml v1.5.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fredbi/uri v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.9.0 // indirect
 	github.com/fyne-io/gl-js v0.2.0 // indirect
 	github.com/fyne-io/glfw-js v0.3.0 // indirect
 	github.com/fyne-io/image v0.1.1 // indirect
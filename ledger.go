@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------
+// Sync ledger (persisted to ~/.mywhoosh2garmin/ledger.json)
+// ---------------------------------------------------------------------------
+
+// ledgerEntry records one activity that is on Garmin Connect.
+type ledgerEntry struct {
+	Source      string    `json:"source"` // archived (or, for migrated markers, MyWhoosh) file
+	SHA256      string    `json:"sha256"` // content hash of the source file
+	Start       time.Time `json:"start"`
+	FixedSHA256 string    `json:"fixed_sha256,omitempty"` // hash of the uploaded, fixed file
+	UploadedAt  time.Time `json:"uploaded_at"`
+	UploadID    string    `json:"upload_id,omitempty"`
+	ActivityID  string    `json:"activity_id,omitempty"` // Garmin activity ID(s), comma-separated
+
+	// Duplicate is set when Garmin already had the activity, so nothing
+	// was uploaded by this entry.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// syncLedger is the list of synced activities. It is safe for concurrent
+// use; every change is written back to disk right away.
+type syncLedger struct {
+	path string
+
+	mu      sync.Mutex
+	entries []ledgerEntry
+}
+
+func ledgerPath() string {
+	return filepath.Join(appConfigDir(), "ledger.json")
+}
+
+// openLedger loads the ledger at path. A missing file is an empty ledger.
+func openLedger(path string) (*syncLedger, error) {
+	l := &syncLedger{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Synced reports whether the activity with this key is in the ledger.
+func (l *syncLedger) Synced(key activityKey) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.SHA256 == key.SHA256 && e.Start.Equal(key.Start) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasContent reports whether an activity whose file hashes to sha is in
+// the ledger. The hash covers the start time, so this is Synced without
+// decoding the file.
+func (l *syncLedger) HasContent(sha string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.SHA256 == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records e and saves the ledger.
+func (l *syncLedger) Add(e ledgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, e)
+	return l.save()
+}
+
+// save writes the ledger through a temporary file, so a crash can't leave
+// it half written. The caller holds l.mu.
+func (l *syncLedger) save() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// migrateMarkers moves the .synced marker files older versions wrote into
+// the MyWhoosh directory into the ledger and deletes them. Markers that no
+// longer match their file's content describe a ride that was overwritten;
+// they are deleted without an entry. It returns the number of entries added.
+func (l *syncLedger) migrateMarkers(dir string) (int, error) {
+	markers, err := filepath.Glob(filepath.Join(dir, "*.fit.synced"))
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, marker := range markers {
+		fitPath := strings.TrimSuffix(marker, ".synced")
+		if key, err := readActivityKey(fitPath); err == nil {
+			if syncedAt, ok := readSyncMarker(marker, fitPath, key); ok && !l.Synced(key) {
+				err := l.Add(ledgerEntry{
+					Source:     fitPath,
+					SHA256:     key.SHA256,
+					Start:      key.Start,
+					UploadedAt: syncedAt,
+				})
+				if err != nil {
+					return migrated, err
+				}
+				migrated++
+			}
+		}
+		if err := os.Remove(marker); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// syncMarker is the content of a .synced marker file.
+type syncMarker struct {
+	activityKey
+	SyncedAt time.Time `json:"synced_at"`
+}
+
+// readSyncMarker reports whether the marker records the file's current
+// content, and when it was synced. The oldest markers only hold the sync
+// time; they count when the file hasn't been written since.
+func readSyncMarker(marker, fitPath string, key activityKey) (time.Time, bool) {
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var m syncMarker
+	if err := json.Unmarshal(data, &m); err == nil {
+		return m.SyncedAt, m.SHA256 == key.SHA256 && m.Start.Equal(key.Start)
+	}
+
+	syncedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	info, err := os.Stat(fitPath)
+	return syncedAt, err == nil && !info.ModTime().After(syncedAt)
+}
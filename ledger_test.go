@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rewriteTestFile saves a different ride under the same name, with the
+// first record's power set to power.
+func rewriteTestFile(t *testing.T, path string, power uint16) {
+	t.Helper()
+
+	activity := decodeTestFile(t, path)
+	activity.Records[0].Power = power
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := encodeActivity(f, activity); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLedgerTracksContent(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit")
+	createTestFitFile(t, path)
+
+	ledger, err := openLedger(filepath.Join(tmpDir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := findUnsyncedFitFiles(tmpDir, ledger, dateRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("found %d files, want 1", len(files))
+	}
+	key := files[0].Key
+	if key.SHA256 == "" || key.Start.IsZero() {
+		t.Errorf("incomplete key: %+v", key)
+	}
+	err = ledger.Add(ledgerEntry{Source: path, SHA256: key.SHA256, Start: key.Start, UploadedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen to check the entry was persisted.
+	ledger, err = openLedger(filepath.Join(tmpDir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := findUnsyncedFitFiles(tmpDir, ledger, dateRange{}); len(files) != 0 {
+		t.Fatalf("found %d files after sync, want 0", len(files))
+	}
+
+	// A later ride saved under the same name is a new activity.
+	rewriteTestFile(t, path, 250)
+	files, err = findUnsyncedFitFiles(tmpDir, ledger, dateRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("found %d files after overwrite, want 1", len(files))
+	}
+}
+
+func TestLedgerMigrateMarkers(t *testing.T) {
+	tmpDir := t.TempDir()
+	write := func(name, marker string) string {
+		path := filepath.Join(tmpDir, name)
+		createTestFitFile(t, path)
+		if err := os.WriteFile(path+".synced", []byte(marker), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	later := time.Now().Add(time.Hour).Format(time.RFC3339)
+	earlier := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	synced := write("a.fit", later)   // written before the marker: synced
+	stale := write("b.fit", earlier)  // rewritten after the marker: a new ride
+	overwritten := write("c.fit", "") // hash marker for older content
+	rewriteTestFile(t, stale, 250)
+	rewriteTestFile(t, overwritten, 260)
+	if err := os.WriteFile(overwritten+".synced",
+		[]byte(`{"sha256":"0000","start":"2024-01-01T00:00:00Z","synced_at":"2024-01-01T01:00:00Z"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A marker whose FIT file is gone.
+	if err := os.WriteFile(filepath.Join(tmpDir, "gone.fit.synced"), []byte(later), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := openLedger(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ledger.migrateMarkers(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("migrated %d markers, want 1", n)
+	}
+	if markers, _ := filepath.Glob(filepath.Join(tmpDir, "*.synced")); len(markers) != 0 {
+		t.Errorf("markers left behind: %v", markers)
+	}
+
+	files, err := findUnsyncedFitFiles(tmpDir, ledger, dateRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsynced := map[string]bool{}
+	for _, f := range files {
+		unsynced[f.Path] = true
+	}
+	if unsynced[synced] || !unsynced[stale] || !unsynced[overwritten] {
+		t.Errorf("unsynced = %v, want %s and %s", unsynced, stale, overwritten)
+	}
+}
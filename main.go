@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -22,8 +25,24 @@ import (
 // ---------------------------------------------------------------------------
 
 type appConfig struct {
-	MyWhooshDir string `json:"mywhoosh_dir"`
-	Email       string `json:"email"`
+	// MyWhooshDirs are the MyWhoosh FIT file directories to sync.
+	MyWhooshDirs []string `json:"mywhoosh_dirs"`
+
+	// LegacyDir is the single directory older versions saved.
+	// loadAppConfig moves it into MyWhooshDirs.
+	LegacyDir string `json:"mywhoosh_dir,omitempty"`
+
+	Email string `json:"email"`
+
+	// LookbackDays is how many days back a sync looks for activities;
+	// 0 syncs the whole history.
+	LookbackDays int `json:"lookback_days"`
+
+	Fix fixConfig `json:"fix"`
+}
+
+func defaultAppConfig() appConfig {
+	return appConfig{LookbackDays: defaultLookbackDays, Fix: defaultFixConfig()}
 }
 
 func appConfigDir() string {
@@ -31,15 +50,45 @@ func appConfigDir() string {
 	return filepath.Join(home, ".mywhoosh2garmin")
 }
 
+// loadAppConfig reads the config file on top of the defaults, so settings
+// missing from older files keep their default values. The first load
+// generates and saves this installation's device serial number, and an
+// older file's single directory is moved into the directory list.
 func loadAppConfig() appConfig {
-	var cfg appConfig
+	cfg := defaultAppConfig()
 	data, err := os.ReadFile(filepath.Join(appConfigDir(), "config.json"))
 	if err == nil {
 		json.Unmarshal(data, &cfg)
 	}
+	save := false
+	if cfg.LegacyDir != "" {
+		if len(cfg.MyWhooshDirs) == 0 {
+			cfg.MyWhooshDirs = []string{cfg.LegacyDir}
+		}
+		cfg.LegacyDir = ""
+		save = true
+	}
+	if cfg.Fix.Device.SerialNumber == 0 {
+		cfg.Fix.Device.SerialNumber = newSerialNumber()
+		save = true
+	}
+	if save {
+		saveAppConfig(cfg)
+	}
 	return cfg
 }
 
+// splitDirs returns the directories in a text with one directory per line.
+func splitDirs(text string) []string {
+	var dirs []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
 func saveAppConfig(cfg appConfig) {
 	dir := appConfigDir()
 	os.MkdirAll(dir, 0o700)
@@ -52,18 +101,26 @@ func saveAppConfig(cfg appConfig) {
 // ---------------------------------------------------------------------------
 
 func main() {
+	if code, ok := runCLI(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	a := app.New()
 	w := a.NewWindow("MyWhoosh2Garmin")
-	w.Resize(fyne.NewSize(620, 520))
+	w.Resize(fyne.NewSize(620, 620))
 
 	cfg := loadAppConfig()
 
 	// --- Widgets ---
 
-	dirEntry := widget.NewEntry()
-	dirEntry.SetPlaceHolder("Path to MyWhoosh FIT file directory")
-	if cfg.MyWhooshDir != "" {
-		dirEntry.SetText(cfg.MyWhooshDir)
+	dirEntry := widget.NewMultiLineEntry()
+	dirEntry.SetPlaceHolder("Path to MyWhoosh FIT file directory (one per line)")
+	dirEntry.SetMinRowsVisible(2)
+	dirEntry.SetText(strings.Join(cfg.MyWhooshDirs, "\n"))
+	setDirs := func(dirs []string) {
+		cfg.MyWhooshDirs = dirs
+		dirEntry.SetText(strings.Join(dirs, "\n"))
+		saveAppConfig(cfg)
 	}
 
 	emailEntry := widget.NewEntry()
@@ -75,6 +132,126 @@ func main() {
 	passwordEntry := widget.NewPasswordEntry()
 	passwordEntry.SetPlaceHolder("Garmin password (only needed first time)")
 
+	productEntry := widget.NewEntry()
+	productEntry.SetPlaceHolder("Garmin product ID (e.g. 4062 for Edge 840)")
+	if cfg.Fix.Device.ProductID != 0 {
+		productEntry.SetText(strconv.Itoa(int(cfg.Fix.Device.ProductID)))
+	}
+
+	serialEntry := widget.NewEntry()
+	serialEntry.SetPlaceHolder("Device serial number")
+	serialEntry.SetText(strconv.FormatUint(uint64(cfg.Fix.Device.SerialNumber), 10))
+	serialBtn := widget.NewButton("🎲", func() {
+		serialEntry.SetText(strconv.FormatUint(uint64(newSerialNumber()), 10))
+	})
+
+	fetchAthleteCheck := widget.NewCheck("Fetch FTP, heart rate & weight from Garmin on next sync", func(on bool) {
+		cfg.Fix.Athlete.FetchFromGarmin = on
+		saveAppConfig(cfg)
+	})
+	fetchAthleteCheck.SetChecked(cfg.Fix.Athlete.FetchFromGarmin)
+
+	// Sync range: a lookback preset, or a custom from/to date range.
+	sinceEntry := widget.NewEntry()
+	sinceEntry.SetPlaceHolder("From (YYYY-MM-DD)")
+	untilEntry := widget.NewEntry()
+	untilEntry.SetPlaceHolder("To (YYYY-MM-DD, optional)")
+	customRange := container.NewGridWithColumns(2, sinceEntry, untilEntry)
+
+	const customRangeOption = "Custom date range…"
+	rangeOptions := []struct {
+		name string
+		days int
+	}{
+		{"Last 7 days", 7},
+		{"Last 30 days", 30},
+		{"Last 90 days", 90},
+		{"Last year", 365},
+		{"Everything (backfill, slower)", 0},
+	}
+	rangeNames := []string{}
+	for _, o := range rangeOptions {
+		rangeNames = append(rangeNames, o.name)
+	}
+	rangeNames = append(rangeNames, customRangeOption)
+
+	rangeSelect := widget.NewSelect(rangeNames, func(name string) {
+		if name == customRangeOption {
+			customRange.Show()
+			return
+		}
+		customRange.Hide()
+		for _, o := range rangeOptions {
+			if o.name == name {
+				cfg.LookbackDays = o.days
+			}
+		}
+		saveAppConfig(cfg)
+	})
+	for _, o := range rangeOptions {
+		if o.days == cfg.LookbackDays {
+			rangeSelect.SetSelected(o.name)
+		}
+	}
+	if rangeSelect.Selected == "" {
+		sinceEntry.SetText(lookbackRange(cfg.LookbackDays, time.Now()).Since.Format("2006-01-02"))
+		rangeSelect.SetSelected(customRangeOption)
+	}
+
+	// syncRange returns the range picked in the GUI and the pause between
+	// uploads it calls for.
+	syncRange := func() (dateRange, time.Duration, error) {
+		now := time.Now()
+		if rangeSelect.Selected != customRangeOption {
+			rng := lookbackRange(cfg.LookbackDays, now)
+			if cfg.LookbackDays == 0 {
+				return rng, backfillThrottle, nil
+			}
+			return rng, 0, nil
+		}
+		var rng dateRange
+		var err error
+		if rng.Since, err = parseRangeTime(sinceEntry.Text, now, false); err != nil {
+			return rng, 0, err
+		}
+		if untilEntry.Text != "" {
+			if rng.Until, err = parseRangeTime(untilEntry.Text, now, true); err != nil {
+				return rng, 0, err
+			}
+		}
+		if rng.IsBackfill(now) {
+			return rng, backfillThrottle, nil
+		}
+		return rng, 0, nil
+	}
+
+	const customDeviceOption = "Custom product ID…"
+	deviceOptions := []string{}
+	for _, p := range spoofProfiles {
+		deviceOptions = append(deviceOptions, p.Name)
+	}
+	deviceOptions = append(deviceOptions, customDeviceOption)
+
+	deviceSelect := widget.NewSelect(deviceOptions, func(name string) {
+		cfg.Fix.Device.Profile = customProfileID
+		for _, p := range spoofProfiles {
+			if p.Name == name {
+				cfg.Fix.Device.Profile = p.ID
+			}
+		}
+		if cfg.Fix.Device.Profile == customProfileID {
+			productEntry.Show()
+		} else {
+			productEntry.Hide()
+		}
+		saveAppConfig(cfg)
+	})
+	if p, err := cfg.Fix.Device.profile(); err == nil && p.ID != customProfileID {
+		deviceSelect.SetSelected(p.Name)
+	} else {
+		deviceSelect.SetSelected(customDeviceOption)
+	}
+
 	logLabel := widget.NewLabel("")
 	logLabel.Wrapping = fyne.TextWrapWord
 	logScroll := container.NewVScroll(logLabel)
@@ -101,7 +278,7 @@ func main() {
 
 	// --- Find MyWhoosh Dir button ---
 	findBtn := widget.NewButton("🔍  Find MyWhoosh Dir", func() {
-		dir, err := findMyWhooshDir()
+		candidates, err := findDirCandidates()
 		if err != nil {
 			appendLog("Auto-detect not available: " + err.Error())
 			appendLog("Pick the directory manually…")
@@ -109,134 +286,171 @@ func main() {
 				if err != nil || uri == nil {
 					return
 				}
-				dirEntry.SetText(uri.Path())
-				cfg.MyWhooshDir = uri.Path()
-				saveAppConfig(cfg)
-				appendLog("✓ Directory set: " + uri.Path())
+				setDirs(append(splitDirs(dirEntry.Text), uri.Path()))
+				appendLog("✓ Directory added: " + uri.Path())
 			}, w)
 			return
 		}
-		dirEntry.SetText(dir)
-		cfg.MyWhooshDir = dir
-		saveAppConfig(cfg)
-		appendLog("✓ Found MyWhoosh dir: " + dir)
-	})
-
-	// --- Sync button ---
-	var syncing bool
-	syncBtn := widget.NewButton("🔄  Sync to Garmin", nil)
-	syncBtn.Importance = widget.HighImportance
-
-	syncBtn.OnTapped = func() {
-		if syncing {
+		if len(candidates) == 1 {
+			setDirs([]string{candidates[0].Path})
+			appendLog("✓ Found MyWhoosh dir: " + candidates[0].String())
 			return
 		}
-		syncing = true
-		syncBtn.Disable()
-
-		go func() {
-			defer func() {
-				syncing = false
-				syncBtn.Enable()
-			}()
-
-			// Persist config
-			cfg.MyWhooshDir = dirEntry.Text
-			cfg.Email = emailEntry.Text
-			saveAppConfig(cfg)
 
-			if cfg.MyWhooshDir == "" {
-				appendLog("❌ Set MyWhoosh directory first")
+		// Several installs: let the user pick which ones to sync.
+		options := make([]string, len(candidates))
+		for i, c := range candidates {
+			options[i] = c.String()
+		}
+		choice := widget.NewCheckGroup(options, nil)
+		choice.SetSelected([]string{options[0]})
+		dialog.ShowCustomConfirm("Choose MyWhoosh directories", "Use", "Cancel", choice, func(ok bool) {
+			if !ok {
 				return
 			}
-
-			// 1. Find unsynced FIT files
-			appendLog("Scanning for unsynced activities (last 30 days)…")
-			files, err := findUnsyncedFitFiles(cfg.MyWhooshDir)
-			if err != nil {
-				appendLog("❌ Scan failed: " + err.Error())
-				return
+			var dirs []string
+			for i, c := range candidates {
+				for _, sel := range choice.Selected {
+					if sel == options[i] {
+						dirs = append(dirs, c.Path)
+					}
+				}
 			}
-			if len(files) == 0 {
-				appendLog("✓ Everything is already synced!")
+			if len(dirs) == 0 {
 				return
 			}
-			appendLog(fmt.Sprintf("Found %d unsynced activity file(s)", len(files)))
-
-			// 2. Authenticate to Garmin
-			tokenDir := appConfigDir()
-			client := garmin.NewClient(tokenDir)
-
-			if err := client.Resume(); err == nil {
-				appendLog("Garmin session resumed")
-			} else {
-				email := emailEntry.Text
-				password := passwordEntry.Text
-				if email == "" || password == "" {
-					appendLog("❌ Enter Garmin email & password for first login")
-					return
-				}
-				appendLog("Logging in to Garmin Connect…")
-				if err := client.Login(email, password); err != nil {
-					appendLog("❌ Login failed: " + err.Error())
-					return
-				}
-				appendLog("✓ Logged in to Garmin Connect")
+			setDirs(dirs)
+			for _, dir := range dirs {
+				appendLog("✓ Directory set: " + dir)
 			}
+		}, w)
+	})
 
-			// 3. Process + upload each file
-			tmpDir := os.TempDir()
-			success, skipped := 0, 0
+	// newSyncer persists the form and builds a syncer from it. It returns
+	// nil when the config is invalid.
+	newSyncer := func() *syncer {
+		cfg.MyWhooshDirs = splitDirs(dirEntry.Text)
+		cfg.Email = emailEntry.Text
+		if id, err := strconv.ParseUint(productEntry.Text, 10, 16); err == nil {
+			cfg.Fix.Device.ProductID = uint16(id)
+		}
+		if n, err := strconv.ParseUint(serialEntry.Text, 10, 32); err == nil && n != 0 {
+			cfg.Fix.Device.SerialNumber = uint32(n)
+		}
+		saveAppConfig(cfg)
 
-			for i, fitFile := range files {
-				name := filepath.Base(fitFile)
-				appendLog(fmt.Sprintf("\n[%d/%d] %s", i+1, len(files), name))
+		if err := cfg.Fix.validate(); err != nil {
+			appendLog("❌ " + err.Error())
+			return nil
+		}
+		rng, throttle, err := syncRange()
+		if err != nil {
+			appendLog("❌ Sync range: " + err.Error())
+			return nil
+		}
 
-				outPath := filepath.Join(tmpDir, generateOutputFilename(fitFile))
+		return &syncer{
+			Dirs:       cfg.MyWhooshDirs,
+			Email:      emailEntry.Text,
+			Password:   passwordEntry.Text,
+			TokenDir:   appConfigDir(),
+			LedgerPath: ledgerPath(),
+			ArchiveDir: archiveDir(),
+			Range:      rng,
+			Throttle:   throttle,
+			Fix:        cfg.Fix,
+			SaveAthleteProfile: func(p *garmin.AthleteProfile) {
+				cfg.Fix.Athlete.mergeGarmin(p)
+				saveAppConfig(cfg)
+				fyne.Do(func() { fetchAthleteCheck.SetChecked(false) })
+			},
+			PromptMFA: func(ctx context.Context) (string, error) { return promptMFACode(ctx, w) },
+			Log:       appendLog,
+		}
+	}
 
-				if err := fixFitFile(fitFile, outPath); err != nil {
-					appendLog("  ❌ Processing failed: " + err.Error())
-					skipped++
-					continue
-				}
+	// --- Sync button (turns into Cancel while syncing) ---
+	const syncLabel = "🔄  Sync to Garmin"
+	var cancelSync context.CancelFunc
+	syncBtn := widget.NewButton(syncLabel, nil)
+	syncBtn.Importance = widget.HighImportance
 
-				appendLog("  Uploading…")
-				if err := client.UploadFIT(outPath); err != nil {
-					if strings.Contains(err.Error(), "duplicate") {
-						markSynced(fitFile)
-						appendLog("  ⚠ Already on Garmin (marked synced)")
-					} else {
-						appendLog("  ❌ Upload failed: " + err.Error())
-						skipped++
-					}
-					os.Remove(outPath)
-					continue
-				}
+	syncBtn.OnTapped = func() {
+		if cancelSync != nil {
+			cancelSync()
+			syncBtn.Disable() // until the run has wound down
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelSync = cancel
+		syncBtn.SetText("⏹  Cancel sync")
 
-				markSynced(fitFile)
-				os.Remove(outPath)
-				success++
-				appendLog("  ✓ Uploaded")
-			}
+		go func() {
+			defer func() {
+				cancel()
+				fyne.Do(func() {
+					cancelSync = nil
+					syncBtn.SetText(syncLabel)
+					syncBtn.Enable()
+				})
+			}()
 
-			appendLog(fmt.Sprintf("\n✓ Sync complete — %d uploaded, %d skipped", success, skipped))
+			if s := newSyncer(); s != nil {
+				s.Run(ctx)
+			}
 		}()
 	}
 
+	// --- Watch checkbox ---
+	var stopWatch context.CancelFunc
+	var watchCheck *widget.Check
+	watchCheck = widget.NewCheck("Watch for new rides and sync them automatically", func(on bool) {
+		if !on {
+			if stopWatch != nil {
+				stopWatch()
+				stopWatch = nil
+			}
+			return
+		}
+		s := newSyncer()
+		if s == nil {
+			watchCheck.SetChecked(false)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopWatch = cancel
+		go func() {
+			w := &watcher{Syncer: s, QueuePath: retryQueuePath()}
+			if err := w.Run(ctx); err != nil {
+				fyne.Do(func() { watchCheck.SetChecked(false) })
+			}
+		}()
+	})
+
 	// --- Layout ---
 	title := widget.NewRichTextFromMarkdown("## MyWhoosh → Garmin")
 
 	form := container.NewVBox(
 		title,
 		widget.NewSeparator(),
-		widget.NewLabel("MyWhoosh Directory"),
+		widget.NewLabel("MyWhoosh Directories"),
 		dirEntry,
 		findBtn,
+		widget.NewLabel("Sync activities from"),
+		rangeSelect,
+		customRange,
+		widget.NewSeparator(),
+		widget.NewLabel("Record as device"),
+		deviceSelect,
+		productEntry,
+		container.NewBorder(nil, nil, widget.NewLabel("Serial"), serialBtn, serialEntry),
 		widget.NewSeparator(),
 		widget.NewLabel("Garmin Connect"),
 		emailEntry,
 		passwordEntry,
+		fetchAthleteCheck,
 		syncBtn,
+		watchCheck,
 		widget.NewSeparator(),
 	)
 
@@ -244,3 +458,35 @@ func main() {
 	w.SetContent(content)
 	w.ShowAndRun()
 }
+
+// promptMFACode asks for the Garmin two-factor code in a dialog over win
+// and waits for the answer, or closes the dialog when ctx is done. It must
+// be called off the UI goroutine.
+func promptMFACode(ctx context.Context, win fyne.Window) (string, error) {
+	answer := make(chan string, 1)
+	var form *dialog.FormDialog
+	fyne.Do(func() {
+		code := widget.NewEntry()
+		code.SetPlaceHolder("Code from your authenticator app, email or SMS")
+		items := []*widget.FormItem{widget.NewFormItem("Code", code)}
+		form = dialog.NewForm("Garmin two-factor authentication", "Verify", "Cancel", items, func(ok bool) {
+			if !ok {
+				answer <- ""
+				return
+			}
+			answer <- code.Text
+		}, win)
+		form.Show()
+	})
+	var code string
+	select {
+	case code = <-answer:
+	case <-ctx.Done():
+		fyne.Do(func() { form.Hide() })
+		return "", ctx.Err()
+	}
+	if code == "" {
+		return "", fmt.Errorf("cancelled")
+	}
+	return code, nil
+}
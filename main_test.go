@@ -87,29 +87,7 @@ func TestFixFitFile(t *testing.T) {
 	}
 
 	// Read back and verify
-	f, err := os.Open(outputPath)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer f.Close()
-
-	lis := filedef.NewListener()
-	defer lis.Close()
-
-	dec := decoder.New(f,
-		decoder.WithMesgListener(lis),
-		decoder.WithBroadcastOnly(),
-	)
-
-	_, err = dec.Decode()
-	if err != nil {
-		t.Fatalf("decode fixed file: %v", err)
-	}
-
-	result, ok := lis.File().(*filedef.Activity)
-	if !ok {
-		t.Fatalf("expected activity file, got %T", lis.File())
-	}
+	result := decodeTestFile(t, outputPath)
 
 	// Verify temperature was removed from all records
 	for i, rec := range result.Records {
@@ -135,6 +113,35 @@ func TestFixFitFile(t *testing.T) {
 	}
 }
 
+// decodeTestFile decodes the FIT activity at path.
+func decodeTestFile(t *testing.T, path string) *filedef.Activity {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lis := filedef.NewListener()
+	defer lis.Close()
+
+	dec := decoder.New(f,
+		decoder.WithMesgListener(lis),
+		decoder.WithBroadcastOnly(),
+	)
+
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+
+	result, ok := lis.File().(*filedef.Activity)
+	if !ok {
+		t.Fatalf("expected activity file, got %T", lis.File())
+	}
+	return result
+}
+
 func TestFindMostRecentFitFile(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -168,6 +175,66 @@ func TestGenerateOutputFilename(t *testing.T) {
 	}
 }
 
+func TestReadActivityFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MyNewActivity-3.8.5.fit")
+	createTestFitFile(t, path)
+
+	f, err := readActivityFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Meta.Start.IsZero() || !f.Meta.Start.Equal(f.Key.Start) {
+		t.Errorf("start = %s, key start = %s", f.Meta.Start, f.Key.Start)
+	}
+	if f.Meta.Sport != "cycling" {
+		t.Errorf("sport = %q, want cycling", f.Meta.Sport)
+	}
+	if f.Meta.Duration != 9*time.Second {
+		t.Errorf("duration = %s, want 9s from the records", f.Meta.Duration)
+	}
+}
+
+func TestFindUnsyncedFitFilesOrder(t *testing.T) {
+	tmpDir := t.TempDir()
+	now := time.Now()
+
+	// The later ride has the older modification time, as after a restore.
+	for i, name := range []string{"b.fit", "a.fit"} {
+		path := filepath.Join(tmpDir, name)
+		createTestFitFile(t, path)
+		activity := decodeTestFile(t, path)
+		activity.Sessions[0].StartTime = now.Add(-time.Duration(i+1) * time.Hour)
+		out, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeActivity(out, activity); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+		mtime := now.Add(-time.Duration(2-i) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ledger, err := openLedger(filepath.Join(tmpDir, "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := findUnsyncedFitFiles(tmpDir, ledger, dateRange{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("found %d files, want 2", len(files))
+	}
+	if filepath.Base(files[0].Path) != "a.fit" || filepath.Base(files[1].Path) != "b.fit" {
+		t.Errorf("order = %s, %s; want a.fit (earlier start) first",
+			filepath.Base(files[0].Path), filepath.Base(files[1].Path))
+	}
+}
+
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && searchSubstr(s, substr)
 }
@@ -180,3 +247,55 @@ func searchSubstr(s, sub string) bool {
 	}
 	return false
 }
+
+func TestWineDataDirs(t *testing.T) {
+	home := t.TempDir()
+	dataDir := func(prefix, user string) string {
+		return filepath.Join(home, filepath.FromSlash(prefix), "drive_c", "users", user,
+			"AppData", "Local", "Packages", "MyWhooshTechnologyService.abc123",
+			"LocalCache", "Local", "MyWhoosh", "Content", "Data")
+	}
+	want := []string{
+		dataDir(".wine", "me"),
+		dataDir(".steam/steam/steamapps/compatdata/2330/pfx", "steamuser"),
+		dataDir(".local/share/bottles/bottles/MyWhoosh", "me"),
+	}
+	for _, dir := range want {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A prefix without MyWhoosh.
+	if err := os.MkdirAll(filepath.Join(home, "Games", "other", "drive_c", "users", "me"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	got := wineDataDirs(home)
+	if len(got) != len(want) {
+		t.Fatalf("found %d dirs: %v, want %d", len(got), got, len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("dir %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDescribeDir(t *testing.T) {
+	tmpDir := t.TempDir()
+	createTestFitFile(t, filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit"))
+	if err := os.WriteFile(filepath.Join(tmpDir, "broken.fit"), []byte("fake"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := describeDir(tmpDir)
+	if c.FitFiles != 2 {
+		t.Errorf("FitFiles = %d, want 2", c.FitFiles)
+	}
+	if c.Newest.IsZero() || time.Since(c.Newest) > time.Minute {
+		t.Errorf("Newest = %s, want the test activity's start", c.Newest)
+	}
+	if !contains(c.String(), "2 FIT files") {
+		t.Errorf("String() = %q", c.String())
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/muktihari/fit/profile/filedef"
+)
+
+// ---------------------------------------------------------------------------
+// Fix pipeline
+// ---------------------------------------------------------------------------
+
+// fixer is one named step of the fix pipeline.
+type fixer interface {
+	// Name identifies the step in logs and reports.
+	Name() string
+	// Fix modifies the activity in place and describes each change it made.
+	Fix(activity *filedef.Activity) ([]string, error)
+}
+
+// fixConfig enables and configures the pipeline steps. It is persisted as
+// part of appConfig and can be overridden with command line flags.
+type fixConfig struct {
+	Athlete     athleteConfig     `json:"athlete"`
+	Summary     summaryConfig     `json:"summary"`
+	Profile     profileConfig     `json:"athlete_profile"`
+	TimeInZone  timeInZoneConfig  `json:"time_in_zone"`
+	Temperature temperatureConfig `json:"strip_temperature"`
+	Device      deviceConfig      `json:"spoof_device"`
+}
+
+// athleteConfig holds the athlete's thresholds used by several steps.
+type athleteConfig struct {
+	FTP         uint16  `json:"ftp,omitempty"`          // functional threshold power, W
+	MaxHR       uint8   `json:"max_hr,omitempty"`       // bpm
+	RestingHR   uint8   `json:"resting_hr,omitempty"`   // bpm
+	ThresholdHR uint8   `json:"threshold_hr,omitempty"` // lactate threshold, bpm
+	WeightKg    float64 `json:"weight_kg,omitempty"`
+
+	// FetchFromGarmin fills the values above that are unset from the
+	// Garmin Connect profile on the next sync, then switches itself off.
+	FetchFromGarmin bool `json:"fetch_from_garmin,omitempty"`
+}
+
+type summaryConfig struct {
+	Enabled   bool `json:"enabled"`
+	Overwrite bool `json:"overwrite"` // recompute even when the file has a value
+	Laps      bool `json:"laps"`      // repair laps as well as sessions
+}
+
+type profileConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type timeInZoneConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type temperatureConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+type deviceConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Profile     string `json:"profile"`                // spoofProfile ID, or "custom"
+	ProductID   uint16 `json:"product_id,omitempty"`   // Garmin product ID for "custom"
+	ProductName string `json:"product_name,omitempty"` // optional name for "custom"
+
+	// SerialNumber is written as the device serial. loadAppConfig generates
+	// a random one per installation when it is unset; it can be replaced
+	// with the serial of the user's real device.
+	SerialNumber uint32 `json:"serial_number"`
+
+	// Sensors controls the device_info entries of sensors (everything but
+	// the file creator), keyed by sensor type such as "heart_rate",
+	// "bike_power" or "fitness_equipment", or "*" for all other types.
+	// Sensors without a rule are kept as recorded.
+	Sensors map[string]sensorRule `json:"sensors,omitempty"`
+}
+
+func defaultFixConfig() fixConfig {
+	return fixConfig{
+		Summary:     summaryConfig{Enabled: true, Laps: true},
+		Profile:     profileConfig{Enabled: true},
+		TimeInZone:  timeInZoneConfig{Enabled: true},
+		Temperature: temperatureConfig{Enabled: true},
+		Device:      deviceConfig{Enabled: true, Profile: defaultProfileID},
+	}
+}
+
+// validate reports configuration errors up front, so they don't fail every
+// file of a run.
+func (c fixConfig) validate() error {
+	if c.Device.Enabled {
+		if _, err := c.Device.profile(); err != nil {
+			return err
+		}
+		// FIT reads both as "no serial", which gives the spoof away
+		if s := c.Device.SerialNumber; s == 0 || s == uint32Invalid {
+			return fmt.Errorf("device serial %d is not a valid serial number (use 1 to 4294967294)", s)
+		}
+	}
+	return nil
+}
+
+// registerFixFlags binds command line flags to cfg, using its current
+// values as defaults.
+func registerFixFlags(fs *flag.FlagSet, cfg *fixConfig) {
+	fs.Var(uint16Flag{&cfg.Athlete.FTP}, "ftp",
+		"functional threshold power in `watts`, for intensity factor and TSS")
+	fs.Var(uint8Flag{&cfg.Athlete.MaxHR}, "max-hr", "max heart rate in `bpm`")
+	fs.Var(uint8Flag{&cfg.Athlete.RestingHR}, "resting-hr", "resting heart rate in `bpm`")
+	fs.Var(uint8Flag{&cfg.Athlete.ThresholdHR}, "threshold-hr", "lactate threshold heart rate in `bpm`")
+	fs.Float64Var(&cfg.Athlete.WeightKg, "weight", cfg.Athlete.WeightKg, "body weight in `kg`")
+	fs.BoolVar(&cfg.Athlete.FetchFromGarmin, "fetch-athlete", cfg.Athlete.FetchFromGarmin,
+		"fill unset FTP, heart rates and weight from the Garmin Connect profile (sync only, once)")
+	fs.BoolVar(&cfg.Profile.Enabled, "athlete-profile", cfg.Profile.Enabled,
+		"write the athlete values into the zones_target and user_profile messages")
+	fs.BoolVar(&cfg.Summary.Enabled, "summary", cfg.Summary.Enabled,
+		"fill in missing or wrong session and lap summary fields from the records")
+	fs.BoolVar(&cfg.Summary.Overwrite, "summary-overwrite", cfg.Summary.Overwrite,
+		"recompute summary fields even when the file has them")
+	fs.BoolVar(&cfg.Summary.Laps, "summary-laps", cfg.Summary.Laps,
+		"repair lap summaries as well as the session")
+	fs.BoolVar(&cfg.TimeInZone.Enabled, "time-in-zone", cfg.TimeInZone.Enabled,
+		"add time spent in each power and heart rate zone (needs FTP or max HR)")
+	fs.BoolVar(&cfg.Temperature.Enabled, "strip-temperature", cfg.Temperature.Enabled,
+		"remove the fake temperature from records")
+	fs.BoolVar(&cfg.Device.Enabled, "spoof-device", cfg.Device.Enabled,
+		"rewrite the device identity to a Garmin device")
+	fs.StringVar(&cfg.Device.Profile, "device", cfg.Device.Profile,
+		"device `profile` to spoof: "+strings.Join(spoofProfileIDs(), ", "))
+	fs.Func("device-serial", "device serial `number` to write (default from config)", func(v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return err
+		}
+		cfg.Device.SerialNumber = uint32(n)
+		return nil
+	})
+	fs.Func("sensor", "what to do with a sensor's device_info: `TYPE=ACTION` with ACTION keep, spoof\n"+
+		"or map:MANUFACTURER:PRODUCT; TYPE * matches all types (repeatable)", func(v string) error {
+		typ, rule, err := parseSensorRule(v)
+		if err != nil {
+			return err
+		}
+		if cfg.Device.Sensors == nil {
+			cfg.Device.Sensors = map[string]sensorRule{}
+		}
+		cfg.Device.Sensors[typ] = rule
+		return nil
+	})
+	fs.Func("device-product-id", "Garmin product `ID` to spoof (selects the custom profile)", func(v string) error {
+		id, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return err
+		}
+		cfg.Device.Profile = customProfileID
+		cfg.Device.ProductID = uint16(id)
+		return nil
+	})
+}
+
+// uint16Flag is a flag.Value for a uint16 config field.
+type uint16Flag struct{ p *uint16 }
+
+func (f uint16Flag) String() string {
+	if f.p == nil || *f.p == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*f.p))
+}
+
+func (f uint16Flag) Set(v string) error {
+	n, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		return err
+	}
+	*f.p = uint16(n)
+	return nil
+}
+
+// uint8Flag is a flag.Value for a uint8 config field.
+type uint8Flag struct{ p *uint8 }
+
+func (f uint8Flag) String() string {
+	if f.p == nil || *f.p == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(*f.p))
+}
+
+func (f uint8Flag) Set(v string) error {
+	n, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return err
+	}
+	*f.p = uint8(n)
+	return nil
+}
+
+// fixPipeline is an ordered list of fix steps.
+type fixPipeline []fixer
+
+// newFixPipeline builds the pipeline for the enabled steps in cfg.
+func newFixPipeline(cfg fixConfig) fixPipeline {
+	var p fixPipeline
+	if cfg.Summary.Enabled {
+		p = append(p, &summaryFixer{cfg: cfg.Summary, athlete: cfg.Athlete})
+	}
+	if cfg.Profile.Enabled {
+		p = append(p, &athleteFixer{athlete: cfg.Athlete})
+	}
+	if cfg.TimeInZone.Enabled {
+		p = append(p, &timeInZoneFixer{athlete: cfg.Athlete})
+	}
+	if cfg.Temperature.Enabled {
+		p = append(p, &temperatureFixer{})
+	}
+	if cfg.Device.Enabled {
+		p = append(p, &deviceFixer{cfg: cfg.Device})
+	}
+	return p
+}
+
+// stepReport lists the changes one step made.
+type stepReport struct {
+	Step    string
+	Changes []string
+}
+
+// fixReport lists the changes made by each step of a pipeline run.
+type fixReport []stepReport
+
+// Changed reports whether any step changed the activity.
+func (r fixReport) Changed() bool {
+	for _, s := range r {
+		if len(s.Changes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Run applies every step to the activity in order and logs the changes.
+func (p fixPipeline) Run(activity *filedef.Activity) (fixReport, error) {
+	var report fixReport
+	for _, f := range p {
+		changes, err := f.Fix(activity)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		for _, c := range changes {
+			logFn("  → %s\n", c)
+		}
+		report = append(report, stepReport{Step: f.Name(), Changes: changes})
+	}
+	return report, nil
+}
+
+// FixFile reads the FIT activity at inputPath, runs the pipeline on it and
+// writes the result to outputPath.
+func (p fixPipeline) FixFile(inputPath, outputPath string) (fixReport, error) {
+	f, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	activity, err := decodeActivity(f)
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := p.Run(activity)
+	if err != nil {
+		return report, err
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return report, err
+	}
+	defer out.Close()
+
+	return report, encodeActivity(out, activity)
+}
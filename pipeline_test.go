@@ -0,0 +1,96 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/muktihari/fit/profile/typedef"
+)
+
+func TestFixPipelineSelectedSteps(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit")
+	outputPath := filepath.Join(tmpDir, "fixed.fit")
+	createTestFitFile(t, inputPath)
+
+	// Keep the temperature but still spoof the device.
+	cfg := defaultFixConfig()
+	cfg.Temperature.Enabled = false
+	pipeline := newFixPipeline(cfg)
+
+	report, err := pipeline.FixFile(inputPath, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range report {
+		if step.Step == "strip-temperature" {
+			t.Errorf("disabled step %q ran", step.Step)
+		}
+	}
+	if !report.Changed() {
+		t.Error("report has no changes")
+	}
+
+	result := decodeTestFile(t, outputPath)
+	for i, rec := range result.Records {
+		if rec.Temperature != 25 {
+			t.Errorf("record %d: temperature %d, want 25 kept", i, rec.Temperature)
+		}
+	}
+	if result.FileId.Manufacturer != typedef.ManufacturerGarmin {
+		t.Errorf("manufacturer: got %s, want garmin", result.FileId.Manufacturer)
+	}
+}
+
+func TestFixPipelineNoSteps(t *testing.T) {
+	var cfg fixConfig // everything disabled
+	if p := newFixPipeline(cfg); len(p) != 0 {
+		t.Errorf("got %d steps, want 0", len(p))
+	}
+}
+
+func TestFixConfigValidateSerial(t *testing.T) {
+	cfg := defaultFixConfig()
+	for _, serial := range []uint32{0, 0xFFFFFFFF} {
+		cfg.Device.SerialNumber = serial
+		if err := cfg.validate(); err == nil {
+			t.Errorf("serial %d accepted", serial)
+		}
+	}
+	cfg.Device.SerialNumber = 3412345678
+	if err := cfg.validate(); err != nil {
+		t.Errorf("serial %d: %v", cfg.Device.SerialNumber, err)
+	}
+}
+
+func TestFixPipelineAthleteRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "MyNewActivity-3.8.5.fit")
+	outputPath := filepath.Join(tmpDir, "fixed.fit")
+	createTestFitFile(t, inputPath)
+
+	cfg := defaultFixConfig()
+	cfg.Athlete = athleteConfig{FTP: 250, MaxHR: 190, WeightKg: 70}
+	if _, err := newFixPipeline(cfg).FixFile(inputPath, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	result := decodeTestFile(t, outputPath)
+	if len(result.ZonesTargets) != 1 || result.ZonesTargets[0].FunctionalThresholdPower != 250 {
+		t.Errorf("zones_target not written: %+v", result.ZonesTargets)
+	}
+	if result.UserProfile == nil || result.UserProfile.Weight != 700 {
+		t.Errorf("user_profile not written: %+v", result.UserProfile)
+	}
+	if len(result.TimeInZones) != 2 { // session + lap
+		t.Fatalf("got %d time_in_zone messages, want 2", len(result.TimeInZones))
+	}
+	if len(result.TimeInZones[0].TimeInPowerZone) != 7 {
+		t.Errorf("power zones: %v", result.TimeInZones[0].TimeInPowerZone)
+	}
+
+	// The zones read back from the file are recognised as up to date.
+	if changes, _ := (&timeInZoneFixer{athlete: cfg.Athlete}).Fix(result); len(changes) != 0 {
+		t.Errorf("fixed file: time in zone changed %q", changes)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+)
+
+// ---------------------------------------------------------------------------
+// Summary recomputation
+// ---------------------------------------------------------------------------
+
+const (
+	// maxRecordGap is the longest gap between two records that still counts
+	// as riding; longer gaps are pauses and count as a single second.
+	maxRecordGap = 5 * time.Second
+
+	// npWindow is the rolling average window for normalized power.
+	npWindow = 30
+
+	// grossEfficiency converts mechanical work to energy burned: roughly
+	// 24% of the energy a cyclist burns ends up at the pedals.
+	grossEfficiency = 0.24
+)
+
+// recordStats are summary values computed from a stream of records.
+type recordStats struct {
+	PowerSamples     int
+	HeartRateSamples int
+	CadenceSamples   int
+
+	AvgPower        uint16
+	MaxPower        uint16
+	NormalizedPower uint16 // 0 when the ride is shorter than npWindow
+	AvgHeartRate    uint8
+	MaxHeartRate    uint8
+	AvgCadence      uint8
+	MaxCadence      uint8
+
+	TotalWork uint32 // joules
+	Seconds   int    // riding time covered by the power samples
+}
+
+// computeRecordStats computes the summary values of records.
+func computeRecordStats(records []*mesgdef.Record) recordStats {
+	var st recordStats
+	var powers []uint16
+	var heartRates, cadences []uint8
+
+	for _, rec := range records {
+		if rec.Power != uint16Invalid {
+			powers = append(powers, rec.Power)
+			st.MaxPower = max(st.MaxPower, rec.Power)
+		}
+		if rec.HeartRate != uint8Invalid {
+			heartRates = append(heartRates, rec.HeartRate)
+			st.MaxHeartRate = max(st.MaxHeartRate, rec.HeartRate)
+		}
+		if rec.Cadence != uint8Invalid {
+			cadences = append(cadences, rec.Cadence)
+			st.MaxCadence = max(st.MaxCadence, rec.Cadence)
+		}
+	}
+
+	st.PowerSamples, st.HeartRateSamples, st.CadenceSamples = len(powers), len(heartRates), len(cadences)
+	if len(powers) > 0 {
+		st.AvgPower = avgU16(powers)
+	}
+	if len(heartRates) > 0 {
+		st.AvgHeartRate = avgU8(heartRates)
+	}
+	if len(cadences) > 0 {
+		st.AvgCadence = avgU8(cadences)
+	}
+
+	series := powerSeries(records)
+	st.Seconds = len(series)
+	var work float64
+	for _, p := range series {
+		work += p
+	}
+	st.TotalWork = uint32(work)
+	st.NormalizedPower = normalizedPower(series)
+	return st
+}
+
+// powerSeries resamples record power to one value per second, holding each
+// sample until the next record.
+func powerSeries(records []*mesgdef.Record) []float64 {
+	var series []float64
+	for i, rec := range records {
+		if rec.Power == uint16Invalid {
+			continue
+		}
+		secs := 1
+		if i+1 < len(records) {
+			gap := records[i+1].Timestamp.Sub(rec.Timestamp)
+			if gap <= maxRecordGap {
+				secs = int(gap.Round(time.Second) / time.Second)
+			}
+		}
+		for ; secs > 0; secs-- {
+			series = append(series, float64(rec.Power))
+		}
+	}
+	return series
+}
+
+// normalizedPower returns the fourth-root mean of the fourth powers of the
+// 30 s rolling average power, or 0 for rides shorter than the window.
+func normalizedPower(series []float64) uint16 {
+	if len(series) < npWindow {
+		return 0
+	}
+	var window, sum4 float64
+	n := 0
+	for i, p := range series {
+		window += p
+		if i >= npWindow {
+			window -= series[i-npWindow]
+		}
+		if i >= npWindow-1 {
+			sum4 += math.Pow(window/npWindow, 4)
+			n++
+		}
+	}
+	return uint16(math.Round(math.Pow(sum4/float64(n), 0.25)))
+}
+
+// caloriesFromWork estimates kcal burned for an amount of work in joules.
+func caloriesFromWork(joules uint32) uint16 {
+	return uint16(math.Round(float64(joules) / 4184 / grossEfficiency))
+}
+
+// summaryFixer fills in missing or wrong session and lap summary fields
+// from the record stream.
+type summaryFixer struct {
+	cfg     summaryConfig
+	athlete athleteConfig
+}
+
+func (f *summaryFixer) Name() string { return "summary" }
+
+func (f *summaryFixer) Fix(activity *filedef.Activity) ([]string, error) {
+	st := computeRecordStats(activity.Records)
+
+	logFn("Records: %d | Power: %d | HR: %d | Cadence: %d samples\n",
+		len(activity.Records), st.PowerSamples, st.HeartRateSamples, st.CadenceSamples)
+
+	var changes []string
+	for _, sess := range activity.Sessions {
+		ftp := f.athlete.FTP
+		if ftp == 0 && !shouldFixU16(sess.ThresholdPower) {
+			ftp = sess.ThresholdPower
+		}
+		changes = append(changes, f.apply(sessionFields(sess), st, ftp, "")...)
+	}
+
+	if f.cfg.Laps {
+		for i, lap := range activity.Laps {
+			lapStats := computeRecordStats(lapRecords(activity, i))
+			prefix := fmt.Sprintf("lap %d: ", i+1)
+			changes = append(changes, f.apply(lapFields(lap), lapStats, 0, prefix)...)
+		}
+	}
+	return changes, nil
+}
+
+// lapRecords returns the records inside lap i: from its start time up to,
+// but excluding, its timestamp (the next lap's start). The last lap includes
+// its end. A lap without start time starts where the previous one ended.
+func lapRecords(activity *filedef.Activity, i int) []*mesgdef.Record {
+	lap := activity.Laps[i]
+	start := lap.StartTime
+	if start.IsZero() && i > 0 {
+		start = activity.Laps[i-1].Timestamp
+	}
+	last := i == len(activity.Laps)-1
+	return recordsBetween(activity.Records, start, lap.Timestamp, last)
+}
+
+// recordsBetween returns the records in [start, end), or [start, end] when
+// inclusive is set. A zero start or end leaves that side open.
+func recordsBetween(records []*mesgdef.Record, start, end time.Time, inclusive bool) []*mesgdef.Record {
+	var result []*mesgdef.Record
+	for _, rec := range records {
+		if !start.IsZero() && rec.Timestamp.Before(start) {
+			continue
+		}
+		if !end.IsZero() && (rec.Timestamp.After(end) || (!inclusive && rec.Timestamp.Equal(end))) {
+			continue
+		}
+		result = append(result, rec)
+	}
+	return result
+}
+
+// summaryFields points at the summary fields of a session or lap. Fields a
+// message doesn't have are nil.
+type summaryFields struct {
+	AvgPower, MaxPower, NormalizedPower *uint16
+	AvgHeartRate, MaxHeartRate          *uint8
+	AvgCadence, MaxCadence              *uint8
+	TotalWork                           *uint32
+	TotalCalories                       *uint16
+	IntensityFactor                     *uint16 // scale 1000
+	TrainingStressScore                 *uint16 // scale 10
+}
+
+func sessionFields(s *mesgdef.Session) summaryFields {
+	return summaryFields{
+		AvgPower:            &s.AvgPower,
+		MaxPower:            &s.MaxPower,
+		NormalizedPower:     &s.NormalizedPower,
+		AvgHeartRate:        &s.AvgHeartRate,
+		MaxHeartRate:        &s.MaxHeartRate,
+		AvgCadence:          &s.AvgCadence,
+		MaxCadence:          &s.MaxCadence,
+		TotalWork:           &s.TotalWork,
+		TotalCalories:       &s.TotalCalories,
+		IntensityFactor:     &s.IntensityFactor,
+		TrainingStressScore: &s.TrainingStressScore,
+	}
+}
+
+// lapFields has no intensity factor or TSS: laps don't carry them.
+func lapFields(l *mesgdef.Lap) summaryFields {
+	return summaryFields{
+		AvgPower:        &l.AvgPower,
+		MaxPower:        &l.MaxPower,
+		NormalizedPower: &l.NormalizedPower,
+		AvgHeartRate:    &l.AvgHeartRate,
+		MaxHeartRate:    &l.MaxHeartRate,
+		AvgCadence:      &l.AvgCadence,
+		MaxCadence:      &l.MaxCadence,
+		TotalWork:       &l.TotalWork,
+		TotalCalories:   &l.TotalCalories,
+	}
+}
+
+// apply writes the computed stats into fields that are missing or wrong,
+// or into all of them with the overwrite option. A maximum is wrong when
+// it is below what the records show. ftp enables intensity factor and TSS.
+// Each change is described, prefixed with prefix.
+func (f *summaryFixer) apply(fields summaryFields, st recordStats, ftp uint16, prefix string) []string {
+	var changes []string
+	changed := func(format string, args ...interface{}) {
+		changes = append(changes, prefix+fmt.Sprintf(format, args...))
+	}
+	fix16 := func(field *uint16, v uint16, wrong bool) bool {
+		if field == nil || v == 0 || !(f.cfg.Overwrite || shouldFixU16(*field) || wrong) || *field == v {
+			return false
+		}
+		*field = v
+		return true
+	}
+	fix8 := func(field *uint8, v uint8, wrong bool) bool {
+		if field == nil || v == 0 || !(f.cfg.Overwrite || shouldFixU8(*field) || wrong) || *field == v {
+			return false
+		}
+		*field = v
+		return true
+	}
+
+	if fix16(fields.AvgPower, st.AvgPower, false) {
+		changed("avg power:      %d W", *fields.AvgPower)
+	}
+	if fix16(fields.MaxPower, st.MaxPower, fields.MaxPower != nil && *fields.MaxPower < st.MaxPower) {
+		changed("max power:      %d W", *fields.MaxPower)
+	}
+	if fix16(fields.NormalizedPower, st.NormalizedPower, false) {
+		changed("norm. power:    %d W", *fields.NormalizedPower)
+	}
+	if fix8(fields.AvgHeartRate, st.AvgHeartRate, false) {
+		changed("avg heart rate: %d bpm", *fields.AvgHeartRate)
+	}
+	if fix8(fields.MaxHeartRate, st.MaxHeartRate, fields.MaxHeartRate != nil && *fields.MaxHeartRate < st.MaxHeartRate) {
+		changed("max heart rate: %d bpm", *fields.MaxHeartRate)
+	}
+	if fix8(fields.AvgCadence, st.AvgCadence, false) {
+		changed("avg cadence:    %d rpm", *fields.AvgCadence)
+	}
+	if fix8(fields.MaxCadence, st.MaxCadence, fields.MaxCadence != nil && *fields.MaxCadence < st.MaxCadence) {
+		changed("max cadence:    %d rpm", *fields.MaxCadence)
+	}
+
+	if fields.TotalWork != nil && st.TotalWork > 0 && *fields.TotalWork != st.TotalWork &&
+		(f.cfg.Overwrite || *fields.TotalWork == 0 || *fields.TotalWork == uint32Invalid) {
+		*fields.TotalWork = st.TotalWork
+		changed("total work:     %d kJ", st.TotalWork/1000)
+	}
+	if fields.TotalWork != nil && *fields.TotalWork != 0 && *fields.TotalWork != uint32Invalid &&
+		fix16(fields.TotalCalories, caloriesFromWork(*fields.TotalWork), false) {
+		changed("calories:       %d kcal", *fields.TotalCalories)
+	}
+
+	// Intensity factor and TSS need the FTP and the normalized power.
+	if ftp == 0 || fields.NormalizedPower == nil || shouldFixU16(*fields.NormalizedPower) {
+		return changes
+	}
+	intensity := float64(*fields.NormalizedPower) / float64(ftp)
+	tss := float64(st.Seconds) * intensity * intensity / 3600 * 100
+	if fix16(fields.IntensityFactor, uint16(math.Round(intensity*1000)), false) {
+		changed("intensity:      %.3f IF", float64(*fields.IntensityFactor)/1000)
+	}
+	if fix16(fields.TrainingStressScore, uint16(math.Round(tss*10)), false) {
+		changed("stress score:   %.1f TSS", float64(*fields.TrainingStressScore)/10)
+	}
+	return changes
+}
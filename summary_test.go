@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+)
+
+// testRecords returns one record per second with the given power values,
+// a heart rate of 100 + i and a cadence of 90.
+func testRecords(start time.Time, powers ...uint16) []*mesgdef.Record {
+	var records []*mesgdef.Record
+	for i, p := range powers {
+		records = append(records, mesgdef.NewRecord(nil).
+			SetTimestamp(start.Add(time.Duration(i)*time.Second)).
+			SetPower(p).
+			SetHeartRate(uint8(100+i)).
+			SetCadence(90))
+	}
+	return records
+}
+
+func constantPowers(n int, watts uint16) []uint16 {
+	powers := make([]uint16, n)
+	for i := range powers {
+		powers[i] = watts
+	}
+	return powers
+}
+
+func TestComputeRecordStats(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	powers := append(constantPowers(30, 100), constantPowers(30, 300)...)
+	st := computeRecordStats(testRecords(start, powers...))
+
+	if st.AvgPower != 200 || st.MaxPower != 300 {
+		t.Errorf("power: avg %d max %d, want 200/300", st.AvgPower, st.MaxPower)
+	}
+	if st.MaxHeartRate != 159 || st.MaxCadence != 90 {
+		t.Errorf("max HR %d cadence %d, want 159/90", st.MaxHeartRate, st.MaxCadence)
+	}
+	if st.TotalWork != 12000 || st.Seconds != 60 {
+		t.Errorf("work %d J over %d s, want 12000 J over 60 s", st.TotalWork, st.Seconds)
+	}
+	// Variable power: NP must exceed the average.
+	if st.NormalizedPower <= st.AvgPower || st.NormalizedPower > st.MaxPower {
+		t.Errorf("normalized power %d outside (%d, %d]", st.NormalizedPower, st.AvgPower, st.MaxPower)
+	}
+}
+
+func TestPowerSeriesPause(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	records := testRecords(start, 100, 100, 100)
+	records[2].Timestamp = start.Add(10 * time.Minute) // paused after the second record
+	records[1].Timestamp = start.Add(2 * time.Second)
+
+	if got := powerSeries(records); len(got) != 4 {
+		t.Errorf("got %d seconds, want 2 + 1 (pause) + 1", len(got))
+	}
+}
+
+func TestNormalizedPowerConstant(t *testing.T) {
+	series := make([]float64, 120)
+	for i := range series {
+		series[i] = 250
+	}
+	if np := normalizedPower(series); np != 250 {
+		t.Errorf("got %d, want 250", np)
+	}
+	if np := normalizedPower(series[:npWindow-1]); np != 0 {
+		t.Errorf("short ride: got %d, want 0", np)
+	}
+}
+
+func TestSummaryFixerSession(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	sess := mesgdef.NewSession(nil).SetStartTime(start).SetMaxPower(150)
+	records := testRecords(start, constantPowers(3600, 200)...)
+
+	f := &summaryFixer{}
+	changes := f.apply(sessionFields(sess), computeRecordStats(records), 250, "")
+	if len(changes) == 0 {
+		t.Fatal("no changes")
+	}
+
+	if sess.MaxPower != 200 {
+		t.Errorf("max power below the records should be fixed: got %d", sess.MaxPower)
+	}
+	if sess.NormalizedPower != 200 {
+		t.Errorf("normalized power: got %d, want 200", sess.NormalizedPower)
+	}
+	if sess.TotalWork != 720000 {
+		t.Errorf("total work: got %d J, want 720000", sess.TotalWork)
+	}
+	if sess.TotalCalories != caloriesFromWork(720000) {
+		t.Errorf("calories: got %d", sess.TotalCalories)
+	}
+	if sess.IntensityFactor != 800 {
+		t.Errorf("intensity factor: got %d, want 800 (0.8)", sess.IntensityFactor)
+	}
+	if sess.TrainingStressScore != 640 {
+		t.Errorf("TSS: got %d, want 640 (64.0)", sess.TrainingStressScore)
+	}
+}
+
+func TestSummaryFixerKeepsValidValues(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	sess := mesgdef.NewSession(nil).SetAvgPower(190).SetMaxPower(400)
+	st := computeRecordStats(testRecords(start, constantPowers(60, 200)...))
+
+	(&summaryFixer{}).apply(sessionFields(sess), st, 0, "")
+	if sess.AvgPower != 190 || sess.MaxPower != 400 {
+		t.Errorf("valid values overwritten: avg %d max %d", sess.AvgPower, sess.MaxPower)
+	}
+
+	(&summaryFixer{cfg: summaryConfig{Overwrite: true}}).apply(sessionFields(sess), st, 0, "")
+	if sess.AvgPower != 200 || sess.MaxPower != 200 {
+		t.Errorf("overwrite: avg %d max %d, want 200/200", sess.AvgPower, sess.MaxPower)
+	}
+}
+
+func TestSummaryFixerLaps(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	powers := append(constantPowers(60, 100), constantPowers(60, 300)...)
+
+	activity := filedef.NewActivity()
+	activity.Records = testRecords(start, powers...)
+	activity.Laps = []*mesgdef.Lap{
+		mesgdef.NewLap(nil).SetStartTime(start).SetTimestamp(start.Add(60 * time.Second)),
+		mesgdef.NewLap(nil).SetStartTime(start.Add(60 * time.Second)).SetTimestamp(start.Add(119 * time.Second)),
+	}
+
+	f := &summaryFixer{cfg: summaryConfig{Laps: true}}
+	if _, err := f.Fix(activity); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []uint16{100, 300} {
+		lap := activity.Laps[i]
+		if lap.AvgPower != want || lap.MaxPower != want || lap.NormalizedPower != want {
+			t.Errorf("lap %d: avg %d max %d NP %d, want %d", i+1,
+				lap.AvgPower, lap.MaxPower, lap.NormalizedPower, want)
+		}
+		if lap.TotalWork != uint32(want)*60 {
+			t.Errorf("lap %d: work %d J, want %d", i+1, lap.TotalWork, uint32(want)*60)
+		}
+	}
+	if activity.Laps[1].MaxHeartRate != 219 {
+		t.Errorf("lap 2 max HR: got %d, want 219", activity.Laps[1].MaxHeartRate)
+	}
+}
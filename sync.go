@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mywhoosh2garmin/garmin"
+)
+
+// ---------------------------------------------------------------------------
+// Sync engine (shared by the GUI and the command line)
+// ---------------------------------------------------------------------------
+
+// syncer runs the scan → fix → login → upload pipeline.
+type syncer struct {
+	Dirs     []string // MyWhoosh FIT file directories
+	Email    string
+	Password string
+	TokenDir string // where Garmin tokens are cached
+
+	// ClientOptions configure the Garmin Connect client, e.g. to point it
+	// at a test server. Optional.
+	ClientOptions []garmin.Option
+
+	// Range selects the activities to sync by start time.
+	Range dateRange
+
+	// Throttle is a pause between uploads, for backfilling a history
+	// without hitting Garmin's rate limits. Optional.
+	Throttle time.Duration
+
+	// LedgerPath is the sync ledger file recording what was uploaded.
+	LedgerPath string
+
+	// ArchiveDir is the activity archive. New MyWhoosh files are copied
+	// there first; files are fixed and uploaded from the archive.
+	ArchiveDir string
+
+	// Fix configures the pipeline that fixes each file before upload.
+	Fix fixConfig
+
+	// Retry is the queue of files that failed before. They are skipped
+	// until their retry is due, and the queue is updated after each run.
+	// Optional; without it every failed file is tried again right away.
+	Retry *retryQueue
+
+	// SaveAthleteProfile persists the profile fetched from Garmin Connect
+	// when Fix.Athlete.FetchFromGarmin is set. Optional.
+	SaveAthleteProfile func(*garmin.AthleteProfile)
+
+	// PromptPassword is asked for the password when the cached session
+	// can't be resumed and Password is empty. Optional. Like PromptMFA it
+	// gives up with ctx.Err() when the run is cancelled.
+	PromptPassword func(ctx context.Context) (string, error)
+
+	// PromptMFA is asked for the two-factor code when Garmin challenges
+	// the login. Optional; without it such a login fails.
+	PromptMFA func(ctx context.Context) (string, error)
+
+	// Log receives one progress line per call.
+	Log func(msg string)
+}
+
+// syncResult summarizes a sync run.
+type syncResult struct {
+	Found      int // unsynced files found
+	Uploaded   int
+	Duplicates int // already on Garmin, marked synced
+	Failed     int // processing or upload failures
+	Postponed  int // failed before, not due for a retry yet
+
+	// Deferred lists the MyWhoosh files that weren't complete yet. They
+	// are picked up by a later sync and don't count as failures.
+	Deferred []string
+
+	// Errors holds why each failed file failed, keyed by its archived path.
+	Errors map[string]error
+}
+
+// Deadlines for the Garmin calls of a sync. The login leaves time to type
+// a two-factor code; an upload includes waiting for Garmin to process it.
+const (
+	loginTimeout   = 5 * time.Minute
+	profileTimeout = time.Minute
+	uploadTimeout  = 5 * time.Minute
+)
+
+// syncMu makes sync runs from the GUI button and the watcher take turns, so
+// an activity isn't uploaded twice.
+var syncMu sync.Mutex
+
+func (s *syncer) log(msg string) {
+	if s.Log != nil {
+		s.Log(msg)
+	}
+}
+
+// Run syncs all unsynced activities. It returns an error only when the run
+// couldn't start (no directory, scan or login failure) or ctx was
+// cancelled; per-file failures are counted in the result.
+func (s *syncer) Run(ctx context.Context) (syncResult, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	res := syncResult{Errors: map[string]error{}}
+
+	if len(s.Dirs) == 0 {
+		s.log("❌ Set MyWhoosh directory first")
+		return res, fmt.Errorf("no MyWhoosh directory set")
+	}
+
+	ledger, err := openLedger(s.LedgerPath)
+	if err != nil {
+		s.log("❌ Could not read the sync ledger: " + err.Error())
+		return res, fmt.Errorf("ledger: %w", err)
+	}
+
+	// 1. Archive new MyWhoosh files, then find the unsynced ones
+	archive := activityArchive{dir: s.ArchiveDir}
+	for _, dir := range s.Dirs {
+		if n, err := ledger.migrateMarkers(dir); err != nil {
+			s.log("⚠ Migrating .synced markers failed: " + err.Error())
+		} else if n > 0 {
+			s.log(fmt.Sprintf("Moved %d .synced marker(s) into the sync ledger", n))
+		}
+
+		n, deferred, err := archive.Snapshot(dir)
+		if err != nil {
+			s.log("❌ Archiving failed: " + err.Error())
+			return res, fmt.Errorf("archive: %w", err)
+		}
+		if n > 0 {
+			s.log(fmt.Sprintf("Archived %d new MyWhoosh file(s) from %s", n, dir))
+		}
+		for path, err := range deferred {
+			if errors.Is(err, errNotReady) {
+				s.log(fmt.Sprintf("⏳ %s: %v — will sync it later", filepath.Base(path), err))
+				res.Deferred = append(res.Deferred, path)
+			} else {
+				s.log(fmt.Sprintf("⚠ %s skipped: %v", filepath.Base(path), err))
+			}
+		}
+	}
+
+	s.log(fmt.Sprintf("Scanning for unsynced activities (%s)…", s.Range))
+	files, err := findUnsyncedFitFiles(archive.dir, ledger, s.Range)
+	if err != nil {
+		s.log("❌ Scan failed: " + err.Error())
+		return res, fmt.Errorf("scan: %w", err)
+	}
+	res.Found = len(files)
+	if len(files) == 0 {
+		if len(res.Deferred) == 0 {
+			s.log("✓ Everything is already synced!")
+		}
+		return res, nil
+	}
+	s.log(fmt.Sprintf("Found %d unsynced activity file(s)", len(files)))
+	for _, f := range files {
+		s.log("  • " + f.Meta.String())
+	}
+
+	var postponed []string
+	if s.Retry != nil {
+		files, postponed = s.Retry.Postpone(files, time.Now())
+		res.Postponed = len(postponed)
+		for _, path := range postponed {
+			s.log(fmt.Sprintf("⏳ %s failed before — retrying at %s",
+				filepath.Base(path), s.Retry.items[path].NextTry.Format("15:04")))
+		}
+		if len(files) == 0 {
+			return res, nil
+		}
+	}
+
+	// 2. Authenticate to Garmin
+	client, err := s.authenticate(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	if s.Fix.Athlete.FetchFromGarmin {
+		s.fetchAthlete(ctx, client)
+	}
+
+	// 3. Process + upload each file
+	pipeline := newFixPipeline(s.Fix)
+
+	uploaded := false
+	for i, file := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		fitFile := file.Path
+		name := filepath.Base(fitFile)
+		s.log(fmt.Sprintf("\n[%d/%d] %s — %s", i+1, len(files), file.Meta, name))
+
+		outPath := fixedPath(fitFile)
+
+		if _, err := pipeline.FixFile(fitFile, outPath); err != nil {
+			s.log("  ❌ Processing failed: " + err.Error())
+			res.Failed++
+			res.Errors[fitFile] = err
+			continue
+		}
+
+		entry := ledgerEntry{Source: fitFile, SHA256: file.Key.SHA256, Start: file.Key.Start}
+		entry.FixedSHA256, _ = fileSHA256(outPath)
+
+		if uploaded && s.Throttle > 0 {
+			s.log(fmt.Sprintf("  Waiting %s before the next upload…", s.Throttle))
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.Throttle):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		uploaded = true
+
+		s.log("  Uploading…")
+		uploadCtx, cancel := context.WithTimeout(ctx, uploadTimeout)
+		result, err := client.UploadFIT(uploadCtx, outPath)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		setUploadResult(&entry, result)
+		if errors.Is(err, garmin.ErrRateLimited) {
+			// The remaining uploads would be refused too
+			s.log("  ❌ Garmin is rate limiting uploads — stopping, the rest will be synced later")
+			for _, rest := range files[i:] {
+				res.Failed++
+				res.Errors[rest.Path] = err
+			}
+			break
+		}
+		if err != nil {
+			if errors.Is(err, garmin.ErrDuplicateActivity) {
+				entry.UploadedAt = time.Now()
+				entry.Duplicate = true
+				s.record(ledger, entry)
+				s.log("  ⚠ Already on Garmin (marked synced)")
+				res.Duplicates++
+			} else {
+				s.log("  ❌ Upload failed: " + err.Error())
+				res.Failed++
+				res.Errors[fitFile] = err
+			}
+			continue
+		}
+
+		entry.UploadedAt = time.Now()
+		s.record(ledger, entry)
+		res.Uploaded++
+		if entry.ActivityID != "" {
+			s.log("  ✓ Uploaded — activity " + entry.ActivityID)
+		} else {
+			s.log("  ✓ Uploaded")
+		}
+	}
+
+	if s.Retry != nil && ctx.Err() == nil {
+		if err := s.Retry.Update(res.Errors, postponed, time.Now()); err != nil {
+			s.log("⚠ Could not save the retry queue: " + err.Error())
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		s.log(fmt.Sprintf("\n⏹ Sync cancelled — %d uploaded, the rest will be synced later", res.Uploaded))
+		return res, err
+	}
+	s.log(fmt.Sprintf("\n✓ Sync complete — %d uploaded, %d skipped", res.Uploaded, res.Failed))
+	return res, nil
+}
+
+// setUploadResult links the ledger entry to the Garmin upload and the
+// activities it created (or, for a duplicate, the one already there).
+func setUploadResult(entry *ledgerEntry, result *garmin.UploadResult) {
+	if result == nil {
+		return
+	}
+	if result.UploadID != 0 {
+		entry.UploadID = strconv.FormatInt(result.UploadID, 10)
+	}
+	ids := make([]string, len(result.ActivityIDs))
+	for i, id := range result.ActivityIDs {
+		ids[i] = strconv.FormatInt(id, 10)
+	}
+	entry.ActivityID = strings.Join(ids, ",")
+}
+
+// record adds the entry to the ledger. A failure only warns: the activity
+// is on Garmin, and a later sync is answered as a duplicate.
+func (s *syncer) record(ledger *syncLedger, entry ledgerEntry) {
+	if err := ledger.Add(entry); err != nil {
+		s.log("  ⚠ Could not update the sync ledger: " + err.Error())
+	}
+}
+
+// authenticate resumes the cached Garmin session or logs in afresh.
+func (s *syncer) authenticate(ctx context.Context) (*garmin.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
+
+	client := garmin.NewClient(s.TokenDir, s.ClientOptions...)
+	client.PromptMFA = s.PromptMFA
+
+	if err := client.Resume(ctx); err == nil {
+		s.log("Garmin session resumed")
+		return client, nil
+	}
+
+	password := s.Password
+	if password == "" && s.Email != "" && s.PromptPassword != nil {
+		p, err := s.PromptPassword(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				s.log("⏹ Login cancelled")
+			}
+			return nil, fmt.Errorf("read password: %w", err)
+		}
+		password = p
+	}
+	if s.Email == "" || password == "" {
+		s.log("❌ Enter Garmin email & password for first login")
+		return nil, fmt.Errorf("no Garmin credentials")
+	}
+
+	s.log("Logging in to Garmin Connect…")
+	if err := client.Login(ctx, s.Email, password); err != nil {
+		switch {
+		case errors.Is(err, context.Canceled):
+			s.log("⏹ Login cancelled")
+		case errors.Is(err, garmin.ErrRateLimited):
+			s.log("❌ Garmin is rate limiting logins, try again in a while")
+		case errors.Is(err, garmin.ErrMFARequired):
+			s.log("❌ Login needs a two-factor code, run the sync interactively")
+		default:
+			s.log("❌ Login failed: " + err.Error())
+		}
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	s.log("✓ Logged in to Garmin Connect")
+	return client, nil
+}
+
+// fetchAthlete fills unset athlete values from the Garmin Connect profile
+// and switches the fetch off again. Failures only warn: the sync goes on
+// with the configured values.
+func (s *syncer) fetchAthlete(ctx context.Context, client *garmin.Client) {
+	ctx, cancel := context.WithTimeout(ctx, profileTimeout)
+	defer cancel()
+
+	s.log("Fetching athlete profile from Garmin…")
+	profile, err := client.AthleteProfile(ctx)
+	if err != nil {
+		s.log("⚠ Could not fetch athlete profile: " + err.Error())
+		return
+	}
+	s.Fix.Athlete.mergeGarmin(profile)
+	if s.SaveAthleteProfile != nil {
+		s.SaveAthleteProfile(profile)
+	}
+	s.log("✓ Athlete profile: " + s.Fix.Athlete.String())
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"mywhoosh2garmin/garmin"
+	"mywhoosh2garmin/garmin/garmintest"
+)
+
+// newTestSyncer returns a syncer for two finished rides that uploads to a
+// fake Garmin Connect.
+func newTestSyncer(t *testing.T) (*syncer, *garmintest.Server) {
+	t.Helper()
+	srv := garmintest.NewServer()
+	t.Cleanup(srv.Close)
+
+	gameDir := t.TempDir()
+	for i, power := range []uint16{210, 220} {
+		path := filepath.Join(gameDir, fmt.Sprintf("MyNewActivity-%d.fit", i+1))
+		createTestFitFile(t, path)
+		rewriteTestFile(t, path, power)
+		ageTestFile(t, path)
+	}
+
+	config := t.TempDir()
+	return &syncer{
+		Dirs:          []string{gameDir},
+		Email:         garmintest.DefaultEmail,
+		Password:      garmintest.DefaultPassword,
+		TokenDir:      config,
+		ClientOptions: srv.Options(),
+		LedgerPath:    filepath.Join(config, "ledger.json"),
+		ArchiveDir:    filepath.Join(config, "archive"),
+		Fix:           defaultFixConfig(),
+	}, srv
+}
+
+// ledgerEntries reads back the ledger the syncer wrote.
+func ledgerEntries(t *testing.T, s *syncer) []ledgerEntry {
+	t.Helper()
+	ledger, err := openLedger(s.LedgerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ledger.entries
+}
+
+func TestSyncerRun(t *testing.T) {
+	s, srv := newTestSyncer(t)
+	res, err := s.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Found != 2 || res.Uploaded != 2 || res.Failed != 0 {
+		t.Errorf("result = %+v, want 2 found and uploaded", res)
+	}
+	if n := len(srv.Uploads()); n != 2 {
+		t.Errorf("server received %d files, want 2", n)
+	}
+	entries := ledgerEntries(t, s)
+	if len(entries) != 2 {
+		t.Fatalf("%d ledger entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if e.Duplicate || e.UploadID == "" || e.ActivityID == "" || e.FixedSHA256 == "" {
+			t.Errorf("ledger entry %+v, want an upload with its IDs", e)
+		}
+	}
+
+	// The next run finds nothing to do.
+	res, err = s.Run(context.Background())
+	if err != nil || res.Found != 0 {
+		t.Errorf("second run: found %d (%v), want 0", res.Found, err)
+	}
+	if n := len(srv.Uploads()); n != 2 {
+		t.Errorf("server received %d files after the second run, want 2", n)
+	}
+}
+
+func TestSyncerRunDuplicates(t *testing.T) {
+	s, srv := newTestSyncer(t)
+	srv.UploadMode = garmintest.UploadDuplicate
+
+	res, err := s.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Duplicates != 2 || res.Uploaded != 0 || res.Failed != 0 {
+		t.Errorf("result = %+v, want 2 duplicates", res)
+	}
+	entries := ledgerEntries(t, s)
+	if len(entries) != 2 {
+		t.Fatalf("%d ledger entries, want 2", len(entries))
+	}
+	for _, e := range entries {
+		if !e.Duplicate || e.ActivityID == "" {
+			t.Errorf("ledger entry %+v, want a duplicate pointing at the activity", e)
+		}
+	}
+}
+
+func TestSyncerRunRateLimited(t *testing.T) {
+	s, srv := newTestSyncer(t)
+	srv.UploadMode = garmintest.UploadRateLimited
+
+	res, err := s.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if res.Failed != 2 || res.Uploaded != 0 || len(res.Errors) != 2 {
+		t.Errorf("result = %+v, want both files failed", res)
+	}
+	for path, err := range res.Errors {
+		if !errors.Is(err, garmin.ErrRateLimited) {
+			t.Errorf("%s: got %v, want ErrRateLimited", filepath.Base(path), err)
+		}
+	}
+	if n := len(srv.Uploads()); n != 1 {
+		t.Errorf("server received %d files, want 1: the run stops at the limit", n)
+	}
+	if code := failedExitCode(res.Failed); code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+	if entries := ledgerEntries(t, s); len(entries) != 0 {
+		t.Errorf("%d ledger entries, want none", len(entries))
+	}
+}
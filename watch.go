@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ---------------------------------------------------------------------------
+// Watch mode: sync new rides as soon as MyWhoosh has written them
+// ---------------------------------------------------------------------------
+
+const (
+	defaultDebounce = 10 * time.Second
+	minRetryDelay   = time.Minute
+	maxRetryDelay   = time.Hour
+)
+
+// watcher runs the syncer whenever a FIT file in a MyWhoosh directory is
+// created or changed, once the file has stopped changing.
+type watcher struct {
+	Syncer *syncer
+
+	// Debounce is how long a file's size and modification time must stay
+	// the same before it is synced. Defaults to defaultDebounce.
+	Debounce time.Duration
+
+	// QueuePath is the persistent retry queue of files that failed.
+	QueuePath string
+}
+
+// fileState is the last seen size and modification time of a changed
+// file, and since when it has been unchanged.
+type fileState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// newFileState records the file as seen at now. A file that can't be
+// read yet gets a size no file has, so the first check counts as a change.
+func newFileState(path string, now time.Time) fileState {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileState{size: -1, since: now}
+	}
+	return fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+}
+
+func (w *watcher) debounce() time.Duration {
+	if w.Debounce > 0 {
+		return w.Debounce
+	}
+	return defaultDebounce
+}
+
+// Run watches until ctx is cancelled. It syncs once right away to catch up
+// on rides recorded while it wasn't running. It returns an error only when
+// watching couldn't start.
+func (w *watcher) Run(ctx context.Context) error {
+	s := w.Syncer
+	if len(s.Dirs) == 0 {
+		s.log("❌ Set MyWhoosh directory first")
+		return fmt.Errorf("no MyWhoosh directory set")
+	}
+
+	queue, err := openRetryQueue(w.QueuePath)
+	if err != nil {
+		s.log("❌ Could not read the retry queue: " + err.Error())
+		return fmt.Errorf("retry queue: %w", err)
+	}
+	s.Retry = queue
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fsw.Close()
+	for _, dir := range s.Dirs {
+		if err := fsw.Add(dir); err != nil {
+			s.log("❌ Could not watch " + dir + ": " + err.Error())
+			return fmt.Errorf("watch %s: %w", dir, err)
+		}
+		s.log("👀 Watching " + dir + " for new rides")
+	}
+
+	pending := map[string]fileState{}
+	deferred := map[string]deferredFile{}
+	catchUp := true
+	var runFailures int
+	var retryAt time.Time
+
+	runSync := func() {
+		res, err := s.Run(ctx)
+		if ctx.Err() != nil {
+			return // stopping
+		}
+		now := time.Now()
+		if err != nil {
+			runFailures++
+			retryAt = now.Add(retryDelay(runFailures))
+			s.log(fmt.Sprintf("⚠ Sync failed, retrying at %s", retryAt.Format("15:04")))
+			return
+		}
+		runFailures = 0
+		retryAt = time.Time{}
+		w.updateDeferred(deferred, res.Deferred, now)
+		if next, ok := queue.Next(); ok {
+			s.log(fmt.Sprintf("%d file(s) will be retried, next at %s", queue.Len(), next.Format("15:04")))
+		}
+	}
+
+	timer := time.NewTimer(0) // catch-up sync
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.log("Stopped watching")
+			return nil
+
+		case ev, ok := <-fsw.Events:
+			if !ok {
+				return nil
+			}
+			if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Rename) {
+				continue
+			}
+			if !strings.EqualFold(filepath.Ext(ev.Name), ".fit") {
+				continue
+			}
+			if _, ok := pending[ev.Name]; !ok {
+				pending[ev.Name] = newFileState(ev.Name, time.Now())
+			}
+			timer.Reset(w.debounce())
+
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return nil
+			}
+			s.log("⚠ Watch error: " + err.Error())
+
+		case <-timer.C:
+			now := time.Now()
+			due := w.stableFiles(pending, now) > 0 || catchUp
+			catchUp = false
+			if !retryAt.IsZero() && !now.Before(retryAt) {
+				due = true
+			}
+			if next, ok := queue.Next(); ok && !now.Before(next) {
+				due = true
+			}
+			for _, d := range deferred {
+				if !now.Before(d.next) {
+					due = true
+				}
+			}
+			if due {
+				runSync()
+			}
+			if wake, ok := w.nextWake(pending, deferred, retryAt, queue); ok {
+				timer.Reset(max(time.Until(wake), 0))
+			}
+		}
+	}
+}
+
+// stableFiles removes the pending files that have been unchanged for the
+// debounce period, or that are gone, and returns how many were stable.
+func (w *watcher) stableFiles(pending map[string]fileState, now time.Time) int {
+	stable := 0
+	for path, st := range pending {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(pending, path)
+			continue
+		}
+		if info.Size() != st.size || !info.ModTime().Equal(st.modTime) {
+			pending[path] = fileState{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(st.since) >= w.debounce() {
+			delete(pending, path)
+			stable++
+		}
+	}
+	return stable
+}
+
+// nextWake returns when the watcher has something to do next.
+func (w *watcher) nextWake(pending map[string]fileState, deferred map[string]deferredFile, retryAt time.Time, queue *retryQueue) (time.Time, bool) {
+	var wake time.Time
+	earliest := func(t time.Time) {
+		if !t.IsZero() && (wake.IsZero() || t.Before(wake)) {
+			wake = t
+		}
+	}
+	for _, st := range pending {
+		earliest(st.since.Add(w.debounce()))
+	}
+	for _, d := range deferred {
+		earliest(d.next)
+	}
+	earliest(retryAt)
+	if next, ok := queue.Next(); ok {
+		earliest(next)
+	}
+	return wake, !wake.IsZero()
+}
+
+// deferredFile is a MyWhoosh file a sync couldn't read yet. It is retried
+// with a backoff for as long as it stays unchanged; writing to it again
+// starts over.
+type deferredFile struct {
+	modTime  time.Time
+	attempts int
+	next     time.Time
+}
+
+// updateDeferred replaces deferred with the files a sync just deferred.
+func (w *watcher) updateDeferred(deferred map[string]deferredFile, paths []string, now time.Time) {
+	still := map[string]bool{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		still[path] = true
+		d := deferred[path]
+		if !info.ModTime().Equal(d.modTime) {
+			d = deferredFile{modTime: info.ModTime()}
+		}
+		d.attempts++
+		d.next = now.Add(w.deferDelay(d.attempts))
+		deferred[path] = d
+	}
+	for path := range deferred {
+		if !still[path] {
+			delete(deferred, path)
+		}
+	}
+}
+
+// deferDelay backs off exponentially from the debounce period to
+// maxRetryDelay.
+func (w *watcher) deferDelay(attempts int) time.Duration {
+	d := w.debounce()
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// retryDelay backs off exponentially from minRetryDelay to maxRetryDelay.
+func retryDelay(attempts int) time.Duration {
+	d := minRetryDelay
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return min(d, maxRetryDelay)
+}
+
+// ---------------------------------------------------------------------------
+// Retry queue (persisted to ~/.mywhoosh2garmin/retry.json)
+// ---------------------------------------------------------------------------
+
+// retryItem is a file that failed to sync.
+type retryItem struct {
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error"`
+}
+
+// retryQueue holds the files that failed to sync, keyed by their archived
+// path, with a backoff per file. Syncs skip a queued file until its retry
+// is due.
+type retryQueue struct {
+	path  string
+	items map[string]retryItem
+}
+
+func retryQueuePath() string {
+	return filepath.Join(appConfigDir(), "retry.json")
+}
+
+// openRetryQueue loads the queue at path. A missing file is an empty queue.
+func openRetryQueue(path string) (*retryQueue, error) {
+	q := &retryQueue{path: path, items: map[string]retryItem{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.items); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Postpone splits files into those due for a try at now and the paths of
+// the queued ones that have to wait.
+func (q *retryQueue) Postpone(files []activityFile, now time.Time) (due []activityFile, postponed []string) {
+	for _, f := range files {
+		if item, ok := q.items[f.Path]; ok && now.Before(item.NextTry) {
+			postponed = append(postponed, f.Path)
+			continue
+		}
+		due = append(due, f)
+	}
+	return due, postponed
+}
+
+// Update replaces the queue after a sync: files failing again back off
+// further, postponed files keep waiting, and the rest are dropped.
+func (q *retryQueue) Update(failed map[string]error, postponed []string, now time.Time) error {
+	items := map[string]retryItem{}
+	for _, path := range postponed {
+		if item, ok := q.items[path]; ok {
+			items[path] = item
+		}
+	}
+	for path, err := range failed {
+		item := q.items[path]
+		item.Attempts++
+		item.NextTry = now.Add(retryDelay(item.Attempts))
+		item.LastError = err.Error()
+		items[path] = item
+	}
+	q.items = items
+	return q.save()
+}
+
+// Next returns when the next file is due for a retry.
+func (q *retryQueue) Next() (time.Time, bool) {
+	var next time.Time
+	for _, item := range q.items {
+		if next.IsZero() || item.NextTry.Before(next) {
+			next = item.NextTry
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Len returns the number of queued files.
+func (q *retryQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *retryQueue) save() error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(q.items, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.path, data, 0o600)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"mywhoosh2garmin/garmin/garmintest"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempts); got != tt.want {
+			t.Errorf("retryDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retry.json")
+	q, err := openRetryQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Next(); ok {
+		t.Error("empty queue has a next retry")
+	}
+
+	now := time.Now()
+	failed := map[string]error{"a.fit": errors.New("boom"), "b.fit": errors.New("boom")}
+	if err := q.Update(failed, nil, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Update(map[string]error{"a.fit": errors.New("again")}, nil, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen to check the queue was persisted.
+	q, err = openRetryQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("queue holds %d files, want 1", q.Len())
+	}
+	item := q.items["a.fit"]
+	if item.Attempts != 2 || item.LastError != "again" {
+		t.Errorf("item = %+v, want 2 attempts and the last error", item)
+	}
+	if next, _ := q.Next(); !next.Equal(now.Add(2 * time.Minute)) {
+		t.Errorf("next retry at %s, want %s", next, now.Add(2*time.Minute))
+	}
+}
+
+func TestWatcherStableFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MyNewActivity-3.8.5.fit")
+	if err := os.WriteFile(path, []byte("part"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{Debounce: time.Second}
+	now := time.Now()
+	pending := map[string]fileState{path: {size: -1, since: now}}
+
+	if n := w.stableFiles(pending, now); n != 0 {
+		t.Errorf("first look: %d stable files, want 0", n)
+	}
+	if n := w.stableFiles(pending, now.Add(500*time.Millisecond)); n != 0 {
+		t.Errorf("within debounce: %d stable files, want 0", n)
+	}
+
+	// Still being written: the debounce starts over.
+	if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.stableFiles(pending, now.Add(2*time.Second)); n != 0 {
+		t.Errorf("after a write: %d stable files, want 0", n)
+	}
+	if n := w.stableFiles(pending, now.Add(3*time.Second)); n != 1 {
+		t.Errorf("after debounce: %d stable files, want 1", n)
+	}
+	if len(pending) != 0 {
+		t.Errorf("stable file still pending")
+	}
+}
+
+func TestWatcherStableAfterOneDebounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MyNewActivity-3.8.5.fit")
+	if err := os.WriteFile(path, []byte("ride"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{Debounce: time.Second}
+	now := time.Now()
+	pending := map[string]fileState{path: newFileState(path, now)}
+
+	if n := w.stableFiles(pending, now.Add(time.Second)); n != 1 {
+		t.Errorf("one debounce after the event: %d stable files, want 1", n)
+	}
+}
+
+func TestWatcherDeferredBackoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "MyNewActivity-3.8.5.fit")
+	if err := os.WriteFile(path, []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{Debounce: 10 * time.Second}
+	deferred := map[string]deferredFile{}
+	now := time.Now()
+
+	// An unchanged file that stays unreadable is retried less and less often.
+	var delays []time.Duration
+	for range 4 {
+		w.updateDeferred(deferred, []string{path}, now)
+		delays = append(delays, deferred[path].next.Sub(now))
+	}
+	want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second}
+	if !slices.Equal(delays, want) {
+		t.Errorf("delays = %v, want %v", delays, want)
+	}
+
+	// Written again: the backoff starts over.
+	later := now.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	w.updateDeferred(deferred, []string{path}, now)
+	if d := deferred[path].next.Sub(now); d != 10*time.Second {
+		t.Errorf("after a write: delay %s, want 10s", d)
+	}
+
+	// No longer deferred: dropped.
+	w.updateDeferred(deferred, nil, now)
+	if len(deferred) != 0 {
+		t.Errorf("deferred = %v, want empty", deferred)
+	}
+}
+
+func TestWatcherStops(t *testing.T) {
+	tmpDir := t.TempDir()
+	var logs []string
+	s := &syncer{
+		Dirs:       []string{filepath.Join(tmpDir, "mywhoosh")},
+		LedgerPath: filepath.Join(tmpDir, "ledger.json"),
+		ArchiveDir: filepath.Join(tmpDir, "archive"),
+		Log:        func(msg string) { logs = append(logs, msg) },
+	}
+	if err := os.Mkdir(s.Dirs[0], 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{Syncer: s, QueuePath: filepath.Join(tmpDir, "retry.json")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := w.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) == 0 || logs[len(logs)-1] != "Stopped watching" {
+		t.Errorf("logs = %q", logs)
+	}
+}
+
+func TestSyncerRetryBackoff(t *testing.T) {
+	s, srv := newTestSyncer(t)
+	queue, err := openRetryQueue(filepath.Join(t.TempDir(), "retry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Retry = queue
+	ctx := context.Background()
+
+	srv.UploadMode = garmintest.UploadServerError
+	if res, _ := s.Run(ctx); res.Failed != 2 || queue.Len() != 2 {
+		t.Fatalf("failing run: %d failed, %d queued, want 2 and 2", res.Failed, queue.Len())
+	}
+
+	// Before their retry is due the files aren't tried again.
+	srv.UploadMode = garmintest.UploadOK
+	res, err := s.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Postponed != 2 || res.Uploaded != 0 || len(srv.Uploads()) != 2 {
+		t.Errorf("before the retry: %+v with %d uploads, want 2 postponed and no new upload",
+			res, len(srv.Uploads()))
+	}
+	if queue.Len() != 2 {
+		t.Errorf("%d files queued, want 2 still waiting", queue.Len())
+	}
+
+	// Once due they are, and leave the queue.
+	for path, item := range queue.items {
+		item.NextTry = time.Now().Add(-time.Second)
+		queue.items[path] = item
+	}
+	if res, _ := s.Run(ctx); res.Uploaded != 2 || queue.Len() != 0 {
+		t.Errorf("retry run: %d uploaded, %d queued, want 2 and 0", res.Uploaded, queue.Len())
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+)
+
+// ---------------------------------------------------------------------------
+// Time in zone
+// ---------------------------------------------------------------------------
+
+// Zone upper limits as fractions of FTP (7 Coggan power zones) and of max
+// heart rate (5 zones). The last zone is open-ended.
+var (
+	powerZoneLimits = []float64{0.55, 0.75, 0.90, 1.05, 1.20, 1.50}
+	hrZoneLimits    = []float64{0.60, 0.70, 0.80, 0.90}
+)
+
+// zoneBoundaries returns the high boundary of each zone: the limits scaled
+// by threshold, then open for the last zone.
+func zoneBoundaries(limits []float64, threshold, open float64) []float64 {
+	b := make([]float64, 0, len(limits)+1)
+	for _, l := range limits {
+		b = append(b, math.Round(l*threshold))
+	}
+	return append(b, open)
+}
+
+// zoneIndex returns the zone v falls in: the first whose high boundary is
+// at least v.
+func zoneIndex(boundaries []float64, v float64) int {
+	for i, b := range boundaries {
+		if v <= b {
+			return i
+		}
+	}
+	return len(boundaries) - 1
+}
+
+// recordSeconds returns how long each record's values held: until the next
+// record, with pauses longer than maxRecordGap counting as one second.
+func recordSeconds(records []*mesgdef.Record, i int) float64 {
+	if i+1 >= len(records) {
+		return 1
+	}
+	gap := records[i+1].Timestamp.Sub(records[i].Timestamp)
+	if gap > maxRecordGap {
+		return 1
+	}
+	return gap.Seconds()
+}
+
+// timeInZones sums the seconds records spent in each zone. value returns
+// a record's value and whether it has one.
+func timeInZones(records []*mesgdef.Record, boundaries []float64, value func(*mesgdef.Record) (float64, bool)) []uint32 {
+	secs := make([]float64, len(boundaries))
+	for i, rec := range records {
+		if v, ok := value(rec); ok {
+			secs[zoneIndex(boundaries, v)] += recordSeconds(records, i)
+		}
+	}
+	ms := make([]uint32, len(secs))
+	for i, s := range secs {
+		ms[i] = uint32(math.Round(s * 1000)) // scale 1000
+	}
+	return ms
+}
+
+func recordPower(rec *mesgdef.Record) (float64, bool) {
+	return float64(rec.Power), rec.Power != uint16Invalid
+}
+
+func recordHeartRate(rec *mesgdef.Record) (float64, bool) {
+	return float64(rec.HeartRate), rec.HeartRate != uint8Invalid
+}
+
+// timeInZoneFixer adds time_in_zone messages for the session and each lap,
+// with zones derived from the configured FTP and max heart rate.
+type timeInZoneFixer struct {
+	athlete athleteConfig
+}
+
+func (f *timeInZoneFixer) Name() string { return "time-in-zone" }
+
+func (f *timeInZoneFixer) Fix(activity *filedef.Activity) ([]string, error) {
+	a := f.athlete
+	if a.FTP == 0 && a.MaxHR == 0 {
+		return nil, nil
+	}
+
+	// Replace what we are about to compute, keeping the old messages to
+	// report only what changed.
+	type ref struct {
+		mesg  typedef.MesgNum
+		index typedef.MessageIndex
+	}
+	old := map[ref]*mesgdef.TimeInZone{}
+	kept := activity.TimeInZones[:0]
+	for _, tiz := range activity.TimeInZones {
+		if tiz.ReferenceMesg != typedef.MesgNumSession && tiz.ReferenceMesg != typedef.MesgNumLap {
+			kept = append(kept, tiz)
+			continue
+		}
+		old[ref{tiz.ReferenceMesg, tiz.ReferenceIndex}] = tiz
+	}
+	activity.TimeInZones = kept
+
+	// add appends tiz and reports whether it differs from the old message.
+	add := func(tiz *mesgdef.TimeInZone) bool {
+		activity.TimeInZones = append(activity.TimeInZones, tiz)
+		r := ref{tiz.ReferenceMesg, tiz.ReferenceIndex}
+		prev, ok := old[r]
+		delete(old, r)
+		return !ok || !sameTimeInZone(prev, tiz)
+	}
+
+	var changes []string
+	sessions, laps := 0, 0
+	for i, sess := range activity.Sessions {
+		records := recordsBetween(activity.Records, sess.StartTime, sess.Timestamp, true)
+		if add(f.timeInZone(records, sess.Timestamp, typedef.MesgNumSession, i)) {
+			sessions++
+		}
+	}
+	if sessions > 0 {
+		changes = append(changes, fmt.Sprintf("time in zone:   %d session(s)", sessions))
+	}
+	for i, lap := range activity.Laps {
+		if add(f.timeInZone(lapRecords(activity, i), lap.Timestamp, typedef.MesgNumLap, i)) {
+			laps++
+		}
+	}
+	if laps > 0 {
+		changes = append(changes, fmt.Sprintf("time in zone:   %d lap(s)", laps))
+	}
+	if len(old) > 0 {
+		changes = append(changes, fmt.Sprintf("time in zone:   %d stale message(s) removed", len(old)))
+	}
+	return changes, nil
+}
+
+// sameTimeInZone reports whether a and b hold the same zones and times, in
+// the fields timeInZone sets.
+func sameTimeInZone(a, b *mesgdef.TimeInZone) bool {
+	return a.Timestamp.Equal(b.Timestamp) &&
+		a.FunctionalThresholdPower == b.FunctionalThresholdPower &&
+		a.PwrCalcType == b.PwrCalcType &&
+		a.MaxHeartRate == b.MaxHeartRate &&
+		a.RestingHeartRate == b.RestingHeartRate &&
+		a.ThresholdHeartRate == b.ThresholdHeartRate &&
+		a.HrCalcType == b.HrCalcType &&
+		slices.Equal(a.PowerZoneHighBoundary, b.PowerZoneHighBoundary) &&
+		slices.Equal(a.TimeInPowerZone, b.TimeInPowerZone) &&
+		slices.Equal(a.HrZoneHighBoundary, b.HrZoneHighBoundary) &&
+		slices.Equal(a.TimeInHrZone, b.TimeInHrZone)
+}
+
+// timeInZone builds the time_in_zone message for one session or lap.
+func (f *timeInZoneFixer) timeInZone(records []*mesgdef.Record, ts time.Time, ref typedef.MesgNum, index int) *mesgdef.TimeInZone {
+	a := f.athlete
+	tiz := mesgdef.NewTimeInZone(nil).
+		SetTimestamp(ts).
+		SetReferenceMesg(ref).
+		SetReferenceIndex(typedef.MessageIndex(index))
+
+	if a.FTP != 0 {
+		b := zoneBoundaries(powerZoneLimits, float64(a.FTP), float64(uint16Invalid-1))
+		high := make([]uint16, len(b))
+		for i, v := range b {
+			high[i] = uint16(v)
+		}
+		tiz.SetPowerZoneHighBoundary(high).
+			SetTimeInPowerZone(timeInZones(records, b, recordPower)).
+			SetFunctionalThresholdPower(a.FTP).
+			SetPwrCalcType(typedef.PwrZoneCalcPercentFtp)
+	}
+	if a.MaxHR != 0 {
+		b := zoneBoundaries(hrZoneLimits, float64(a.MaxHR), float64(a.MaxHR))
+		high := make([]uint8, len(b))
+		for i, v := range b {
+			high[i] = uint8(v)
+		}
+		tiz.SetHrZoneHighBoundary(high).
+			SetTimeInHrZone(timeInZones(records, b, recordHeartRate)).
+			SetMaxHeartRate(a.MaxHR).
+			SetHrCalcType(typedef.HrZoneCalcPercentMaxHr)
+		if a.RestingHR != 0 {
+			tiz.SetRestingHeartRate(a.RestingHR)
+		}
+		if a.ThresholdHR != 0 {
+			tiz.SetThresholdHeartRate(a.ThresholdHR)
+		}
+	}
+	return tiz
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muktihari/fit/profile/filedef"
+	"github.com/muktihari/fit/profile/mesgdef"
+	"github.com/muktihari/fit/profile/typedef"
+)
+
+func TestTimeInZoneFixer(t *testing.T) {
+	start := time.Date(2026, 10, 1, 18, 0, 0, 0, time.UTC)
+	// 60 s in Z1 (100 W), 60 s in Z4 (250 W) at FTP 250.
+	powers := append(constantPowers(60, 100), constantPowers(60, 250)...)
+	end := start.Add(119 * time.Second)
+
+	activity := filedef.NewActivity()
+	activity.Records = testRecords(start, powers...)
+	activity.Sessions = []*mesgdef.Session{
+		mesgdef.NewSession(nil).SetStartTime(start).SetTimestamp(end),
+	}
+	activity.Laps = []*mesgdef.Lap{
+		mesgdef.NewLap(nil).SetStartTime(start).SetTimestamp(start.Add(60 * time.Second)),
+		mesgdef.NewLap(nil).SetStartTime(start.Add(60 * time.Second)).SetTimestamp(end),
+	}
+
+	f := &timeInZoneFixer{athlete: athleteConfig{FTP: 250, MaxHR: 200}}
+	if _, err := f.Fix(activity); err != nil {
+		t.Fatal(err)
+	}
+	if len(activity.TimeInZones) != 3 {
+		t.Fatalf("got %d time_in_zone messages, want 1 session + 2 laps", len(activity.TimeInZones))
+	}
+
+	sess := activity.TimeInZones[0]
+	if sess.ReferenceMesg != typedef.MesgNumSession || sess.ReferenceIndex != 0 {
+		t.Errorf("session reference: %s/%d", sess.ReferenceMesg, sess.ReferenceIndex)
+	}
+	if len(sess.TimeInPowerZone) != 7 {
+		t.Fatalf("got %d power zones, want 7", len(sess.TimeInPowerZone))
+	}
+	if sess.TimeInPowerZone[0] != 60000 || sess.TimeInPowerZone[3] != 60000 {
+		t.Errorf("power zones: %v", sess.TimeInPowerZone)
+	}
+	if sess.PowerZoneHighBoundary[0] != 138 || sess.FunctionalThresholdPower != 250 {
+		t.Errorf("power boundaries: %v, FTP %d", sess.PowerZoneHighBoundary, sess.FunctionalThresholdPower)
+	}
+	var hrTotal uint32
+	for _, ms := range sess.TimeInHrZone {
+		hrTotal += ms
+	}
+	if hrTotal != 120000 {
+		t.Errorf("time in HR zones adds up to %d ms, want 120000", hrTotal)
+	}
+
+	lap2 := activity.TimeInZones[2]
+	if lap2.ReferenceMesg != typedef.MesgNumLap || lap2.ReferenceIndex != 1 {
+		t.Errorf("lap reference: %s/%d", lap2.ReferenceMesg, lap2.ReferenceIndex)
+	}
+	if lap2.TimeInPowerZone[0] != 0 || lap2.TimeInPowerZone[3] != 60000 {
+		t.Errorf("lap 2 power zones: %v", lap2.TimeInPowerZone)
+	}
+
+	// Running again replaces the messages instead of adding more, and
+	// reports no changes.
+	changes, err := f.Fix(activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activity.TimeInZones) != 3 {
+		t.Errorf("second run: got %d messages, want 3", len(activity.TimeInZones))
+	}
+	if len(changes) != 0 {
+		t.Errorf("second run changed %q, want nothing", changes)
+	}
+
+	// A new FTP changes every message.
+	f.athlete.FTP = 260
+	if changes, _ := f.Fix(activity); len(changes) != 2 {
+		t.Errorf("new FTP: got changes %q, want sessions and laps", changes)
+	}
+}
+
+func TestTimeInZoneFixerUnconfigured(t *testing.T) {
+	activity := filedef.NewActivity()
+	activity.Sessions = []*mesgdef.Session{mesgdef.NewSession(nil)}
+	if changes, _ := (&timeInZoneFixer{}).Fix(activity); len(changes) != 0 || len(activity.TimeInZones) != 0 {
+		t.Error("without FTP or max HR no zones should be written")
+	}
+}